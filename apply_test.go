@@ -0,0 +1,176 @@
+package sparsecat
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// baseImage writes data to a new file and opens it for writing without truncating it, the way the apply command
+// opens the base image
+func baseImage(t *testing.T, data []byte) *os.File {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "base")
+	err := os.WriteFile(name, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = base.Close() })
+
+	return base
+}
+
+func TestApplyChain(t *testing.T) {
+	const kib = 1024
+
+	base := fill(fill(make([]byte, 64*kib), 0, 16*kib, 1), 32*kib, 8*kib, 2)
+
+	// the first diff changes a block and zeroes another, the second one changes another block and the third one
+	// grows the image
+	first := fill(fill(base, 4*kib, 4*kib, 3), 32*kib, 4*kib, 0)
+	second := fill(first, 48*kib, 4*kib, 4)
+	third := fill(append(append([]byte(nil), second...), make([]byte, 16*kib)...), 70*kib, 2*kib, 5)
+
+	diffs := []struct {
+		header   format.Header
+		sections []format.Section
+		data     []byte
+	}{
+		{
+			header: format.Header{Size: 64 * kib, FromSnapshot: "base", ToSnapshot: "snap1"},
+			sections: []format.Section{
+				{Offset: 4 * kib, Length: 4 * kib},
+				{Offset: 32 * kib, Length: 4 * kib, Zero: true},
+			},
+			data: first,
+		},
+		{
+			header:   format.Header{Size: 64 * kib, FromSnapshot: "snap1", ToSnapshot: "snap2"},
+			sections: []format.Section{{Offset: 48 * kib, Length: 4 * kib}},
+			data:     second,
+		},
+		{
+			header:   format.Header{Size: 80 * kib, FromSnapshot: "snap2", ToSnapshot: "snap3"},
+			sections: []format.Section{{Offset: 70 * kib, Length: 2 * kib}},
+			data:     third,
+		},
+	}
+
+	target := baseImage(t, base)
+
+	// apply the diffs the way the apply command does with -from-snapshot base -check-snapshots
+	snapshot := "base"
+	for _, diff := range diffs {
+		decoder := NewDecoder(bytes.NewReader(writeStream(t, format.RbdDiffv1, diff.header, diff.sections, diff.data)))
+		decoder.FromSnapshot = snapshot
+
+		_, err := decoder.ApplyTo(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoder.Header() != diff.header {
+			t.Errorf("expected header %+v, got %+v", diff.header, decoder.Header())
+		}
+
+		snapshot = decoder.Header().ToSnapshot
+	}
+
+	result, err := os.ReadFile(target.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the holes of the diffs leave the data of the base image in place
+	if !bytes.Equal(result, third) {
+		t.Error("image doesn't match after applying the diffs")
+	}
+
+	// a single stream containing a chain of diffs of the same size results in the same image
+	target = baseImage(t, base)
+
+	var chain bytes.Buffer
+	chain.WriteString("rbd image v2\n")
+	chain.WriteByte('E')
+	chain.WriteString("rbd image diffs v2\n")
+	chain.Write([]byte{2, 0, 0, 0, 0, 0, 0, 0})
+	for _, diff := range diffs[:2] {
+		chain.WriteString("rbd diff v2\n")
+		chain.Write(writeStream(t, format.RbdDiffv2, diff.header, diff.sections, diff.data))
+	}
+
+	decoder := NewDecoder(&chain)
+	decoder.Format = format.RbdExportv2
+	decoder.FromSnapshot = "base"
+
+	_, err = decoder.ApplyTo(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the header describes the chain as a whole
+	expectedHeader := format.Header{Size: 64 * kib, FromSnapshot: "base", ToSnapshot: "snap2"}
+	if decoder.Header() != expectedHeader {
+		t.Errorf("expected header %+v, got %+v", expectedHeader, decoder.Header())
+	}
+
+	result, err = os.ReadFile(target.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, second) {
+		t.Error("image doesn't match after applying the chain")
+	}
+}
+
+func TestApplySnapshotMismatch(t *testing.T) {
+	const kib = 1024
+
+	base := fill(make([]byte, 16*kib), 0, 8*kib, 1)
+	data := fill(base, 0, 4*kib, 2)
+
+	tests := []struct {
+		name         string
+		header       format.Header
+		fromSnapshot string
+	}{
+		{name: "different snapshot", header: format.Header{Size: 32 * kib, FromSnapshot: "snap1", ToSnapshot: "snap2"}, fromSnapshot: "snap0"},
+		{name: "full image", header: format.Header{Size: 32 * kib, ToSnapshot: "snap2"}, fromSnapshot: "snap1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := baseImage(t, base)
+
+			stream := writeStream(t, format.RbdDiffv1, test.header, []format.Section{{Offset: 0, Length: 4 * kib}}, data)
+			decoder := NewDecoder(bytes.NewReader(stream))
+			decoder.FromSnapshot = test.fromSnapshot
+
+			_, err := decoder.ApplyTo(target)
+			if !errors.Is(err, ErrSnapshotMismatch) {
+				t.Fatalf("expected a snapshot mismatch, got %v", err)
+			}
+
+			// the diff is rejected before the image is resized or written
+			result, err := os.ReadFile(target.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(result, base) {
+				t.Error("base image was changed by the rejected diff")
+			}
+		})
+	}
+}
@@ -11,3 +11,15 @@ import (
 func getBlockDeviceSize(f *os.File) (int64, error) {
 	return 0, errors.New("operation not supported")
 }
+
+func getBlockDeviceSectorSize(f *os.File) (int, error) {
+	return 512, nil
+}
+
+func zeroOutBlockDevice(file *os.File, offset int64, length int64) error {
+	return ErrPunchHoleUnsupported
+}
+
+func discardBlockDevice(file *os.File, offset int64, length int64) error {
+	return ErrPunchHoleUnsupported
+}
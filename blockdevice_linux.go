@@ -1,11 +1,21 @@
 package sparsecat
 
 import (
+	"errors"
 	"os"
+	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
+// BLKDISCARD and BLKZEROOUT are missing from x/sys. Like BLKSSZGET they are defined as _IO(0x12, nr), so they are
+// derived from it to get the direction bits of the architecture right.
+const (
+	blkDiscard = unix.BLKSSZGET&^0xff | 119
+	blkZeroOut = unix.BLKSSZGET&^0xff | 127
+)
+
 func getBlockDeviceSize(file *os.File) (size int, err error) {
 	conn, err := file.SyscallConn()
 	if err != nil {
@@ -22,3 +32,57 @@ func getBlockDeviceSize(file *os.File) (size int, err error) {
 
 	return size, err
 }
+
+func getBlockDeviceSectorSize(file *os.File) (size int, err error) {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	connerr := conn.Control(func(fd uintptr) {
+		size, err = unix.IoctlGetInt(int(fd), unix.BLKSSZGET)
+	})
+
+	if connerr != nil {
+		return 0, connerr
+	}
+
+	return size, err
+}
+
+// zeroOutBlockDevice zeroes a range of a block device using BLKZEROOUT. The range must be aligned to the sector size.
+func zeroOutBlockDevice(file *os.File, offset int64, length int64) error {
+	return blockDeviceRangeIoctl(file, blkZeroOut, offset, length)
+}
+
+// discardBlockDevice discards a range of a block device using BLKDISCARD. The range must be aligned to the sector
+// size. Whether the range reads as zeros afterwards depends on the device.
+func discardBlockDevice(file *os.File, offset int64, length int64) error {
+	return blockDeviceRangeIoctl(file, blkDiscard, offset, length)
+}
+
+func blockDeviceRangeIoctl(file *os.File, request uintptr, offset int64, length int64) (err error) {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	blockRange := [2]uint64{uint64(offset), uint64(length)}
+
+	connerr := conn.Control(func(fd uintptr) {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(&blockRange[0])))
+		if errno != 0 {
+			err = syscall.Errno(errno)
+		}
+	})
+
+	if connerr != nil {
+		return connerr
+	}
+
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) {
+		return ErrPunchHoleUnsupported
+	}
+
+	return err
+}
@@ -0,0 +1,181 @@
+package sparsecat
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// newLoopDevice attaches a loop device backed by a file of size bytes filled with 0xff. The test is skipped when
+// loop devices can't be set up, for example when not running as root.
+func newLoopDevice(t *testing.T, size int64) *os.File {
+	t.Helper()
+
+	backing := filepath.Join(t.TempDir(), "backing.img")
+	err := os.WriteFile(backing, bytes.Repeat([]byte{0xff}, int(size)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command("losetup", "--find", "--show", backing).Output()
+	if err != nil {
+		t.Skipf("unable to set up loop device: %s", err)
+	}
+
+	name := strings.TrimSpace(string(output))
+	t.Cleanup(func() {
+		_ = exec.Command("losetup", "--detach", name).Run()
+	})
+
+	device, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = device.Close() })
+
+	return device
+}
+
+func TestWriteToAtBlockDevice(t *testing.T) {
+	const deviceSize = 1 << 20
+	device := newLoopDevice(t, deviceSize)
+
+	data := make([]byte, 256*1024)
+	copy(data[4096:], bytes.Repeat([]byte{1}, 4096))
+	copy(data[128*1024:], bytes.Repeat([]byte{2}, 8192))
+
+	tests := []struct {
+		name     string
+		holeMode HoleMode
+	}{
+		{name: "default", holeMode: HolesKeep},
+		{name: "zero", holeMode: HolesZero},
+		{name: "punch", holeMode: HolesPunch},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := device.WriteAt(bytes.Repeat([]byte{0xff}, deviceSize), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoder := NewDecoder(bytes.NewReader(encodeBytes(t, data)))
+			decoder.HoleMode = test.holeMode
+
+			_, err = decoder.WriteToAt(device)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			written := make([]byte, deviceSize)
+			_, err = device.ReadAt(written, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(written[:len(data)], data) {
+				t.Error("the start of the device doesn't match the file, the old data in the holes hasn't been cleared")
+			}
+
+			// block devices aren't truncated, the data beyond the end of the file stays
+			if !bytes.Equal(written[len(data):], bytes.Repeat([]byte{0xff}, deviceSize-len(data))) {
+				t.Error("the data beyond the end of the file has been changed")
+			}
+		})
+	}
+}
+
+func TestWriteToAtBlockDeviceTooSmall(t *testing.T) {
+	device := newLoopDevice(t, 64*1024)
+
+	data := make([]byte, 128*1024)
+	data[0] = 1
+
+	decoder := NewDecoder(bytes.NewReader(encodeBytes(t, data)))
+	_, err := decoder.WriteToAt(device)
+	if err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Fatalf("expected the device to be too small, got %v", err)
+	}
+}
+
+func TestCharacterDeviceTarget(t *testing.T) {
+	target, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer target.Close()
+
+	info, err := target.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// raw disks are character devices on BSD and macOS, the Encoder has to treat them like block devices
+	if !IsBlockDevice(info) {
+		t.Fatalf("%s isn't reported as a device", os.DevNull)
+	}
+
+	blockDevice, _, err := openBlockDeviceTarget(target, 1<<20)
+	if err != nil || blockDevice != nil {
+		t.Fatalf("character device treated as block device target: %v", err)
+	}
+
+	// character devices can't be truncated, decoding into them must work regardless
+	data := make([]byte, 64*1024)
+	data[100] = 1
+
+	_, err = NewDecoder(bytes.NewReader(encodeBytes(t, data))).WriteToAt(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeBlockDevice(t *testing.T) {
+	const deviceSize = 16 << 20
+	device := newLoopDevice(t, deviceSize)
+
+	_, err := device.WriteAt(make([]byte, deviceSize), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = device.WriteAt(bytes.Repeat([]byte{1}, 4096), 5<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		detectZeroBlocks bool
+		expected         format.Section
+	}{
+		{name: "default", expected: format.Section{Offset: BLK_READ_BUFFER, Length: BLK_READ_BUFFER}},
+		{name: "detect zero blocks", detectZeroBlocks: true, expected: format.Section{Offset: 5 << 20, Length: 4096}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := NewEncoder(device)
+			encoder.DetectZeroBlocks = test.detectZeroBlocks
+
+			sourceMap, err := encoder.Map()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sourceMap.Size != deviceSize {
+				t.Errorf("expected size %d, got %d", deviceSize, sourceMap.Size)
+			}
+
+			if len(sourceMap.Sections) != 1 || sourceMap.Sections[0] != test.expected {
+				t.Errorf("expected section %+v, got %+v", test.expected, sourceMap.Sections)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/svenwiltink/sparsecat"
+)
+
+// runApply implements the apply command, which writes a chain of diffs on top of an existing image
+func runApply(args []string) {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	baseFileName := flags.String("base", "", "the image to apply the diffs to")
+	formatName := flags.String("format", "rbd-diff-v1", "the wire format of the diffs. "+formatNames)
+	decryptKey := flags.String("decrypt-key", "", "decrypt the diffs using the passphrase or key stored in this file")
+	holes := flags.String("holes", "punch", "what to do with the zero records of the diffs. Either punch, zero or discard")
+	checkSnapshots := flags.Bool("check-snapshots", false, "require every diff to start at the snapshot the previous diff ended at")
+	fromSnapshot := flags.String("from-snapshot", "", "require the first diff to start at this snapshot, the one the base image was created from")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s apply -base image.raw [options] diff...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if *baseFileName == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	holeMode := parseHoleMode(*holes)
+	if holeMode == sparsecat.HolesKeep {
+		log.Fatal("-holes keep would leave the old data in place of the zero records")
+	}
+
+	f := getFormat(*formatName, "")
+
+	// the diffs are applied to the existing content of the image, so it must not be truncated
+	base, err := os.OpenFile(*baseFileName, os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatalf("unable to open base image: %s", err)
+	}
+	defer base.Close()
+
+	snapshot := *fromSnapshot
+	for index, diffFileName := range flags.Args() {
+		decoder := sparsecat.NewDecoder(openInput(diffFileName, *decryptKey))
+		decoder.Format = f
+		decoder.HoleMode = holeMode
+		decoder.FromSnapshot = snapshot
+
+		written, err := decoder.ApplyTo(base)
+		if err != nil {
+			log.Fatalf("error applying %s: %s", diffFileName, err)
+		}
+
+		header := decoder.Header()
+		fmt.Printf("applied %s: %s -> %s, %s written\n", diffFileName, snapshotName(header.FromSnapshot), snapshotName(header.ToSnapshot), formatBytes(written))
+
+		// -from-snapshot only applies to the first diff unless the whole chain is checked
+		if !*checkSnapshots {
+			snapshot = ""
+			continue
+		}
+
+		snapshot = header.ToSnapshot
+		if snapshot == "" && index < flags.NArg()-1 {
+			log.Fatalf("%s doesn't end at a snapshot, the diffs following it can't be checked", diffFileName)
+		}
+	}
+
+	err = base.Sync()
+	if err != nil {
+		log.Fatalf("error syncing base image: %s", err)
+	}
+}
+
+// snapshotName describes the snapshot of a diff, which is empty for the start or current state of the image
+func snapshotName(name string) string {
+	if name == "" {
+		return "(none)"
+	}
+
+	return name
+}
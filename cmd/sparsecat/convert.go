@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/svenwiltink/sparsecat"
+)
+
+// runConvert implements the convert command, which re-frames a stream using another wire format
+func runConvert(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	inputFileName := flags.String("if", "-", "the stream to convert. '-' for stdin")
+	outputFileName := flags.String("of", "-", "where to write the converted stream. '-' for stdout")
+	from := flags.String("from", "rbd-diff-v1", "the wire format of the input. "+formatNames)
+	to := flags.String("to", "", "the wire format of the output. "+formatNames)
+	compression := flags.String("compress", "", "compress data sections of the output using gzip or flate. Only supported by the sparsecat-v1 format")
+	decryptKey := flags.String("decrypt-key", "", "decrypt the input using the passphrase or key stored in this file")
+	encryptKey := flags.String("encrypt-key", "", "encrypt the output using the passphrase or key stored in this file")
+	_ = flags.Parse(args)
+
+	if *to == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	fromFormat := getFormat(*from, "")
+	toFormat := getFormat(*to, *compression)
+
+	input := openInput(*inputFileName, *decryptKey)
+
+	outputFile := createOutput(*outputFileName, true)
+	defer outputFile.Close()
+
+	// the output is incomplete when converting fails, so it is removed instead of leaving a corrupt stream behind
+	fail := func(err error) {
+		if *outputFileName != "-" {
+			_ = outputFile.Close()
+			_ = os.Remove(*outputFileName)
+		}
+		log.Fatal(err)
+	}
+
+	if *encryptKey != "" {
+		// the encrypting side is a reader, so the converted stream is piped through it
+		reader, writer := io.Pipe()
+		go func() {
+			_, err := sparsecat.Convert(writer, input, fromFormat, toFormat)
+			writer.CloseWithError(err)
+		}()
+
+		_, err := io.Copy(outputFile, encryptStream(options{encryptKey: *encryptKey}, reader))
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	_, err := sparsecat.Convert(outputFile, input, fromFormat, toFormat)
+	if err != nil {
+		fail(err)
+	}
+}
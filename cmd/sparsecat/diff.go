@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/svenwiltink/sparsecat"
+)
+
+// runDiff implements the diff command, which creates a stream of the changes between two versions of a file
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	oldFileName := flags.String("old", "", "the old version of the file")
+	newFileName := flags.String("new", "", "the new version of the file")
+	outputFileName := flags.String("of", "-", "where to write the diff. '-' for stdout")
+	formatName := flags.String("format", "rbd-diff-v1", "the wire format of the diff. "+formatNames)
+	compression := flags.String("compress", "", "compress data sections using gzip or flate. Only supported by the sparsecat-v1 format")
+	encryptKey := flags.String("encrypt-key", "", "encrypt the diff using the passphrase or key stored in this file")
+	blockSize := flags.Int64("block-size", 4096, "the granularity at which the files are compared")
+	fromSnapshot := flags.String("from-snapshot", "", "the snapshot name of the old file written to the diff")
+	toSnapshot := flags.String("to-snapshot", "", "the snapshot name of the new file written to the diff")
+	_ = flags.Parse(args)
+
+	if *oldFileName == "" || *newFileName == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	oldFile, err := os.Open(*oldFileName)
+	if err != nil {
+		log.Fatalf("unable to open old file: %s", err)
+	}
+	defer oldFile.Close()
+
+	newFile, err := os.Open(*newFileName)
+	if err != nil {
+		log.Fatalf("unable to open new file: %s", err)
+	}
+	defer newFile.Close()
+
+	encoder := sparsecat.NewDiffEncoder(oldFile, newFile)
+	encoder.Format = getFormat(*formatName, *compression)
+	encoder.BlockSize = *blockSize
+	encoder.FromSnapshot = *fromSnapshot
+	encoder.ToSnapshot = *toSnapshot
+
+	outputFile := createOutput(*outputFileName, true)
+	defer outputFile.Close()
+
+	_, err = io.Copy(outputFile, encryptStream(options{encryptKey: *encryptKey}, encoder))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/svenwiltink/sparsecat"
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// runInfo implements the info command, which describes the content of a stream without decoding it
+func runInfo(args []string) {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	inputFileName := flags.String("if", "-", "the stream to inspect. '-' for stdin")
+	formatName := flags.String("format", "rbd-diff-v1", "the wire format of the stream. "+formatNames)
+	decryptKey := flags.String("decrypt-key", "", "decrypt the stream using the passphrase or key stored in this file")
+	jsonOutput := flags.Bool("json", false, "print the result as JSON")
+	_ = flags.Parse(args)
+
+	f := getFormat(*formatName, "")
+
+	input := openInput(*inputFileName, *decryptKey)
+
+	info, err := sparsecat.Inspect(input, f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *jsonOutput {
+		printJSON(info)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "size:\t%s\n", formatBytes(info.Size))
+	if info.FromSnapshot != "" {
+		fmt.Fprintf(writer, "from snapshot:\t%s\n", info.FromSnapshot)
+	}
+	if info.ToSnapshot != "" {
+		fmt.Fprintf(writer, "to snapshot:\t%s\n", info.ToSnapshot)
+	}
+	fmt.Fprintf(writer, "sections:\t%d\n", len(info.Sections))
+	fmt.Fprintf(writer, "data:\t%s\n", formatBytes(info.DataBytes))
+	if info.ZeroBytes > 0 {
+		fmt.Fprintf(writer, "zeros:\t%s\n", formatBytes(info.ZeroBytes))
+	}
+	fmt.Fprintf(writer, "holes:\t%s\n", formatBytes(info.HoleBytes))
+	fmt.Fprintf(writer, "largest section:\t%s\n", formatBytes(info.LargestSection))
+	_ = writer.Flush()
+
+	if len(info.Sections) == 0 {
+		return
+	}
+
+	fmt.Println()
+	printSections(info.Sections)
+}
+
+// printSections prints a table of sections
+func printSections(sections []format.Section) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "offset\tlength\ttype\t")
+	for _, section := range sections {
+		kind := "data"
+		if section.Zero {
+			kind = "zero"
+		}
+		fmt.Fprintf(writer, "%d\t%d\t%s\t\n", section.Offset, section.Length, kind)
+	}
+	_ = writer.Flush()
+}
+
+// openInput opens a stream for reading, decrypting it when a key is given
+func openInput(inputFileName string, decryptKey string) io.Reader {
+	var input io.Reader = os.Stdin
+	if inputFileName != "-" {
+		file, err := os.Open(inputFileName)
+		if err != nil {
+			log.Fatalf("unable to open inputFile: %s", err)
+		}
+		input = file
+	}
+
+	if decryptKey == "" {
+		return input
+	}
+
+	decrypted, err := sparsecat.NewDecryptingReader(input, readKey(decryptKey))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return decrypted
+}
+
+// printJSON prints value as indented JSON
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// formatBytes formats an amount of bytes both exactly and in a human readable unit
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d bytes", bytes)
+	}
+
+	value := float64(bytes)
+	suffix := ""
+	for _, s := range []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"} {
+		value /= unit
+		suffix = s
+		if value < unit {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%d bytes (%.1f %s)", bytes, value, suffix)
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/svenwiltink/sparsecat"
 	"github.com/svenwiltink/sparsecat/format"
 	"io"
 	"log"
+	"net"
 	"os"
 )
 
@@ -16,93 +21,601 @@ const (
 	Receive
 )
 
+type options struct {
+	inputFileName  string
+	outputFileName string
+
+	formatName string
+	// formatSet indicates the format has explicitly been chosen instead of using the default
+	formatSet bool
+	format    format.Format
+
+	disableSparseTarget bool
+	disableFileTruncate bool
+	holeMode            sparsecat.HoleMode
+	detectZeroBlocks    bool
+	zeroBlockSize       int64
+
+	encryptKey string
+	decryptKey string
+
+	listen   string
+	connect  string
+	parallel int
+
+	delta          bool
+	deltaBlockSize int64
+
+	resume    bool
+	offset    int64
+	length    int64
+	rangeSize bool
+
+	tls     bool
+	tlsCert string
+	tlsKey  string
+	tlsCA   string
+}
+
+// formatNames lists the wire formats for the usage of flags
+const formatNames = "Either rbd-diff-v1, rbd-diff-v2, rbd-export-v2 or sparsecat-v1"
+
+// commands are the subcommands of sparsecat. Without a subcommand a file is sent or received.
+var commands = map[string]func(args []string){
+	"apply":   runApply,
+	"convert": runConvert,
+	"diff":    runDiff,
+	"info":    runInfo,
+	"map":     runMap,
+	"verify":  runVerify,
+}
+
 func main() {
-	inputFileName := flag.String("if", "", "input inputFile. '-' for stdin")
-	outputFileName := flag.String("of", "", "output inputFile. '-' for stdout")
-	formatName := flag.String("format", "rbd-diff-v1", "the wire format to use. Currently either rbd-diff-v1 or rbd-diff-v2")
-	receive := flag.Bool("r", false, "receive a file instead of transmitting")
-	disableSparseTarget := flag.Bool("disable-sparse-target", false, "disable sparse writing the target file")
-	disableFileTruncate := flag.Bool("disable-file-truncate", false, "disable truncating the target file, *only use this when you know what you are doing*")
+	log.SetFlags(0)
+
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	var opts options
+	var compression string
+	var holes string
+	var receive bool
+
+	flag.StringVar(&opts.inputFileName, "if", "", "input inputFile. '-' for stdin")
+	flag.StringVar(&opts.outputFileName, "of", "", "output inputFile. '-' for stdout")
+	flag.StringVar(&opts.formatName, "format", "rbd-diff-v1", "the wire format to use. "+formatNames)
+	flag.BoolVar(&receive, "r", false, "receive a file instead of transmitting")
+	flag.BoolVar(&opts.disableSparseTarget, "disable-sparse-target", false, "disable sparse writing the target file")
+	flag.BoolVar(&opts.disableFileTruncate, "disable-file-truncate", false, "disable truncating the target file, *only use this when you know what you are doing*")
+	flag.StringVar(&holes, "holes", "keep", "what to do with holes when receiving into an existing target. Either keep, punch, zero or discard. Use one of the latter together with -disable-file-truncate to overwrite an image in place. Holes of block devices are zeroed by default, discard only clears them when the device guarantees discarded blocks read as zeros")
+	flag.BoolVar(&opts.detectZeroBlocks, "detect-zero-blocks", false, "skip blocks that only contain zeros in addition to holes when sending")
+	flag.Int64Var(&opts.zeroBlockSize, "zero-block-size", 4096, "the block size used by -detect-zero-blocks")
+	flag.StringVar(&compression, "compress", "", "compress data sections using gzip or flate. Only supported by the sparsecat-v1 format")
+	flag.StringVar(&opts.encryptKey, "encrypt-key", "", "encrypt the stream using the passphrase or key stored in this file")
+	flag.StringVar(&opts.decryptKey, "decrypt-key", "", "decrypt the stream using the passphrase or key stored in this file")
+	flag.StringVar(&opts.listen, "listen", "", "receive a file by listening for a sparsecat connection on this address")
+	flag.StringVar(&opts.connect, "connect", "", "send a file to a sparsecat listening on this address")
+	flag.IntVar(&opts.parallel, "parallel", 1, "send the file over this many connections in parallel when using -connect")
+	flag.BoolVar(&opts.delta, "delta", false, "only send the blocks that differ from the copy of the file the receiving side already has. Requires -listen or -connect and must be used on both sides")
+	flag.Int64Var(&opts.deltaBlockSize, "delta-block-size", sparsecat.DefaultDeltaBlockSize, "the size of the blocks compared by -delta")
+	flag.BoolVar(&opts.resume, "resume", false, "when receiving, record the progress and continue where a previous -resume transfer stopped. When sending using -connect, start at the offset requested by the receiving side")
+	flag.Int64Var(&opts.offset, "offset", 0, "start sending at this offset, for example the one reported by a resuming receiver")
+	flag.Int64Var(&opts.length, "length", 0, "only send this many bytes starting at -offset. 0 sends everything up to the end of the input")
+	flag.BoolVar(&opts.rangeSize, "range-size", false, "describe only the range selected by -offset and -length, as if it were a file of its own. By default the size of the whole input is sent")
+	flag.BoolVar(&opts.tls, "tls", false, "secure -listen and -connect transfers using TLS")
+	flag.StringVar(&opts.tlsCert, "tls-cert", "", "the certificate to use for TLS. Required when listening, enables client authentication when connecting")
+	flag.StringVar(&opts.tlsKey, "tls-key", "", "the private key belonging to -tls-cert")
+	flag.StringVar(&opts.tlsCA, "tls-ca", "", "the CA used to verify the other side. When listening this requires clients to authenticate using a certificate")
 
 	flag.Parse()
 
-	log.SetFlags(0)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "format" {
+			opts.formatSet = true
+		}
+	})
+
+	opts.format = getFormat(opts.formatName, compression)
+	checkZeroBlockSize(opts.format, opts.zeroBlockSize)
+
+	opts.holeMode = parseHoleMode(holes)
+
+	if opts.listen != "" && opts.connect != "" {
+		log.Fatal("-listen and -connect can't be used at the same time")
+	}
+
+	if opts.resume && opts.rangeSize {
+		log.Fatal("-resume can't be used together with -range-size")
+	}
+
+	// resuming only writes the data after the checkpoint, which requires sparse writing
+	if opts.resume && opts.disableSparseTarget {
+		log.Fatal("-resume can't be used together with -disable-sparse-target")
+	}
+
+	if opts.parallel > 1 && opts.connect == "" {
+		log.Fatal("-parallel requires -connect")
+	}
+
+	if opts.parallel > 1 && (opts.resume || opts.offset != 0 || opts.length != 0) {
+		log.Fatal("-parallel can't be used together with -resume, -offset or -length")
+	}
+
+	if opts.delta && opts.listen == "" && opts.connect == "" {
+		log.Fatal("-delta requires either -listen or -connect")
+	}
+
+	if opts.delta && (opts.parallel > 1 || opts.resume || opts.offset != 0 || opts.length != 0 || opts.rangeSize) {
+		log.Fatal("-delta can't be used together with -parallel, -resume, -offset, -length or -range-size")
+	}
 
-	f, exists := format.GetByName(*formatName)
-	if !exists {
-		log.Fatalf("Format %s doesn't exist", *formatName)
+	// the block hashes of a delta transfer aren't encrypted, they would reveal which blocks changed
+	if opts.delta && (opts.encryptKey != "" || opts.decryptKey != "") {
+		log.Fatal("-delta can't be used together with -encrypt-key or -decrypt-key, use -tls to protect delta transfers")
+	}
+
+	if opts.tls && opts.listen == "" && opts.connect == "" {
+		log.Fatal("-tls requires either -listen or -connect")
 	}
 
 	operation := Send
-	if *receive {
+	if receive || opts.listen != "" {
 		operation = Receive
 	}
 
 	// apply defaults
-	if operation == Send && *outputFileName == "" {
-		*outputFileName = "-"
+	if operation == Send && opts.outputFileName == "" {
+		opts.outputFileName = "-"
 	}
 
-	if operation == Receive && *inputFileName == "" {
-		*inputFileName = "-"
+	if operation == Receive && opts.inputFileName == "" {
+		opts.inputFileName = "-"
 	}
 
-	inputFile, outputFile := setupFiles(operation, *inputFileName, *outputFileName)
+	if operation == Send {
+		send(opts)
+		return
+	}
 
+	receiveFile(opts)
+}
+
+func send(opts options) {
+	if opts.inputFileName == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if opts.inputFileName == "-" {
+		log.Fatal("input must be a file when sending data")
+	}
+
+	inputFile, err := os.Open(opts.inputFileName)
+	if err != nil {
+		log.Fatalf("unable to open inputFile: %s", err)
+	}
 	defer inputFile.Close()
-	defer outputFile.Close()
 
-	if operation == Send {
-		encoder := sparsecat.NewEncoder(inputFile)
-		encoder.Format = f
-		_, err := io.Copy(outputFile, encoder)
+	if opts.parallel > 1 {
+		sendParallel(opts, inputFile)
+		return
+	}
+
+	if opts.delta {
+		sendDelta(opts, inputFile)
+		return
+	}
+
+	encoder := sparsecat.NewEncoder(inputFile)
+	configureEncoder(opts, encoder)
+	encoder.Offset = opts.offset
+	encoder.Length = opts.length
+	encoder.ReportRangeSize = opts.rangeSize
+
+	stream := encryptStream(opts, encoder)
+
+	if opts.connect != "" {
+		conn, err := dial(opts)
+		if err != nil {
+			log.Fatalf("unable to connect: %s", err)
+		}
+		defer conn.Close()
+
+		remote, err := sparsecat.SendHandshake(conn, sparsecat.Handshake{Format: opts.formatName})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// the encoder only starts reading the source once the stream is sent, so the range can still be changed
+		if opts.resume {
+			encoder.Offset, encoder.Length, err = resumeRange(opts.offset, opts.length, remote.Offset)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("resuming at offset %d", encoder.Offset)
+		}
+
+		err = sparsecat.SendStream(conn, stream)
 		if err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
-	decoder := sparsecat.NewDecoder(inputFile)
-	decoder.Format = f
-	decoder.DisableSparseWriting = *disableSparseTarget
-	decoder.DisableFileTruncate = *disableFileTruncate
+	outputFile := createOutput(opts.outputFileName, true)
+	defer outputFile.Close()
 
-	_, err := io.Copy(outputFile, decoder)
+	_, err = io.Copy(outputFile, stream)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func setupFiles(operation OperationType, inputFileName string, outputFileName string) (*os.File, *os.File) {
-	if inputFileName == "" {
-		flag.Usage()
-		os.Exit(1)
+// resumeRange returns the part of the range selected by -offset and -length the receiving side still needs when it
+// resumes at resumeOffset. A receiving side that is in front of the range receives the entire range.
+func resumeRange(offset int64, length int64, resumeOffset int64) (int64, int64, error) {
+	if resumeOffset <= offset {
+		return offset, length, nil
+	}
+
+	if length == 0 {
+		return resumeOffset, 0, nil
+	}
+
+	if resumeOffset >= offset+length {
+		return 0, 0, fmt.Errorf("resume offset %d is beyond the end of the range", resumeOffset)
+	}
+
+	return resumeOffset, offset + length - resumeOffset, nil
+}
+
+// sendParallel divides the input file into ranges that are each sent over their own connection
+func sendParallel(opts options, inputFile *os.File) {
+	encoders, err := sparsecat.NewParallelEncoders(inputFile, opts.parallel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	streams := make([]io.Reader, len(encoders))
+	for i, encoder := range encoders {
+		configureEncoder(opts, encoder)
+		streams[i] = encryptStream(opts, encoder)
+	}
+
+	err = sparsecat.SendParallel(func() (net.Conn, error) {
+		return dial(opts)
+	}, sparsecat.Handshake{Format: opts.formatName}, streams)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// sendDelta sends only the blocks of the input file that differ from the copy the receiving side already has
+func sendDelta(opts options, inputFile *os.File) {
+	conn, err := dial(opts)
+	if err != nil {
+		log.Fatalf("unable to connect: %s", err)
 	}
+	defer conn.Close()
 
-	var inputFile *os.File
-	var outputFile *os.File
-	var err error
+	handshake := sparsecat.Handshake{Format: opts.formatName, BlockSize: opts.deltaBlockSize}
+	_, err = sparsecat.SendDelta(conn, handshake, func(hashes *sparsecat.BlockHashes) io.Reader {
+		encoder := sparsecat.NewDeltaEncoder(inputFile, hashes)
+		encoder.Format = opts.format
+		return encryptStream(opts, encoder)
+	})
 
-	if inputFileName == "-" {
-		if operation == Send {
-			log.Fatal("input must be a file when sending data")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// configureEncoder applies the options shared by all encoders
+func configureEncoder(opts options, encoder *sparsecat.Encoder) {
+	encoder.Format = opts.format
+	encoder.DetectZeroBlocks = opts.detectZeroBlocks
+	encoder.ZeroBlockSize = opts.zeroBlockSize
+}
+
+// encryptStream encrypts the stream when requested
+func encryptStream(opts options, stream io.Reader) io.Reader {
+	if opts.encryptKey == "" {
+		return stream
+	}
+
+	encrypted, err := sparsecat.NewEncryptingReader(stream, readKey(opts.encryptKey))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return encrypted
+}
+
+// decryptStream decrypts the incoming stream when a key has been set
+func decryptStream(opts options, stream io.Reader) (io.Reader, error) {
+	if opts.decryptKey == "" {
+		return stream, nil
+	}
+
+	return sparsecat.NewDecryptingReader(stream, readKey(opts.decryptKey))
+}
+
+// dial connects to the receiving side, using TLS when requested
+func dial(opts options) (net.Conn, error) {
+	if !opts.tls {
+		return net.Dial("tcp", opts.connect)
+	}
+
+	config, err := sparsecat.NewClientTLSConfig(opts.tlsCA, opts.tlsCert, opts.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.Dial("tcp", opts.connect, config)
+}
+
+func receiveFile(opts options) {
+	var handshake sparsecat.Handshake
+	if opts.formatSet {
+		handshake.Format = opts.formatName
+	}
+
+	var state *sparsecat.ResumeState
+	if opts.resume {
+		if opts.outputFileName == "" || opts.outputFileName == "-" {
+			log.Fatal("-resume requires an output file")
 		}
-		inputFile = os.Stdin
-	} else {
-		inputFile, err = os.Open(inputFileName)
+
+		var err error
+		state, err = sparsecat.OpenResumeState(opts.outputFileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		handshake.Offset = state.Offset()
+		if opts.listen == "" && state.Offset() > 0 {
+			log.Printf("resuming at offset %d, start the sending side using -offset %d", state.Offset(), state.Offset())
+		}
+	}
+
+	if opts.delta {
+		receiveDelta(opts, handshake)
+		return
+	}
+
+	if opts.listen != "" {
+		receiveConnections(opts, handshake, state)
+		return
+	}
+
+	var inputFile *os.File = os.Stdin
+	if opts.inputFileName != "-" {
+		var err error
+		inputFile, err = os.Open(opts.inputFileName)
 		if err != nil {
 			log.Fatalf("unable to open inputFile: %s", err)
 		}
+		defer inputFile.Close()
 	}
 
-	if outputFileName == "-" {
-		outputFile = os.Stdout
-	} else {
-		outputFile, err = os.Create(outputFileName)
+	err := decode(opts, inputFile, state, state == nil && !opts.disableFileTruncate)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// receiveConnections receives the file over one or more connections. Parallel streams are written concurrently
+// to the output file, so it is truncated once up front instead of by each stream.
+func receiveConnections(opts options, handshake sparsecat.Handshake, state *sparsecat.ResumeState) {
+	listener := listen(opts)
+	defer listener.Close()
+
+	// parallel streams share the output file, so it is only truncated once before any of them is received
+	if state == nil && !opts.disableFileTruncate && opts.outputFileName != "-" {
+		createOutput(opts.outputFileName, true).Close()
+	}
+
+	// use the format negotiated during the handshake
+	write := func(remote sparsecat.Handshake, stream io.Reader) error {
+		f, exists := format.GetByName(remote.Format)
+		if !exists {
+			return fmt.Errorf("format %s doesn't exist", remote.Format)
+		}
+
+		if remote.Streams > 1 && state != nil {
+			return errors.New("resuming parallel transfers is not supported")
+		}
+
+		if remote.Streams > 1 && opts.outputFileName == "-" {
+			return errors.New("parallel transfers require an output file")
+		}
+
+		// each stream would clear the ranges of the other streams
+		if remote.Streams > 1 && opts.holeMode != sparsecat.HolesKeep {
+			return errors.New("-holes can't be used for parallel transfers")
+		}
+
+		streamOpts := opts
+		streamOpts.format = f
+		return decode(streamOpts, stream, state, false)
+	}
+
+	err := sparsecat.ReceiveParallel(listener, handshake, write)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// receiveDelta receives a delta transfer over a single connection and applies it to the existing output file
+func receiveDelta(opts options, handshake sparsecat.Handshake) {
+	if opts.outputFileName == "-" {
+		log.Fatal("-delta requires an output file")
+	}
+
+	// the output file contains the copy the sending side compares to, so it must not be truncated
+	outputFile := createOutput(opts.outputFileName, false)
+	defer outputFile.Close()
+
+	listener := listen(opts)
+	defer listener.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		log.Fatalf("error accepting connection: %s", err)
+	}
+	defer conn.Close()
+
+	write := func(remote sparsecat.Handshake, stream io.Reader) error {
+		f, exists := format.GetByName(remote.Format)
+		if !exists {
+			return fmt.Errorf("format %s doesn't exist", remote.Format)
+		}
+
+		input, err := decryptStream(opts, stream)
 		if err != nil {
-			log.Fatalf("unable to create outputFile: %s", err)
+			return err
 		}
+
+		decoder := sparsecat.NewDecoder(input)
+		decoder.Format = f
+		decoder.DisableFileTruncate = opts.disableFileTruncate
+		decoder.HoleMode = opts.holeMode
+
+		_, err = decoder.ApplyTo(outputFile)
+		return err
+	}
+
+	_, err = sparsecat.ReceiveDelta(conn, handshake, outputFile, write)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listen listens on the address of -listen, using TLS when requested
+func listen(opts options) net.Listener {
+	listener, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		log.Fatalf("unable to listen: %s", err)
+	}
+
+	if !opts.tls {
+		return listener
+	}
+
+	config, err := sparsecat.NewServerTLSConfig(opts.tlsCert, opts.tlsKey, opts.tlsCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return tls.NewListener(listener, config)
+}
+
+// decode writes the incoming stream to the output file, truncating it first when requested. When state is set the
+// progress is recorded in it.
+func decode(opts options, input io.Reader, state *sparsecat.ResumeState, truncate bool) error {
+	input, err := decryptStream(opts, input)
+	if err != nil {
+		return err
+	}
+
+	outputFile := createOutput(opts.outputFileName, truncate)
+	defer outputFile.Close()
+
+	decoder := sparsecat.NewDecoder(input)
+	decoder.Format = opts.format
+	decoder.DisableSparseWriting = opts.disableSparseTarget
+	decoder.DisableFileTruncate = opts.disableFileTruncate
+	decoder.HoleMode = opts.holeMode
+
+	if state != nil {
+		decoder.Checkpoint = state.Checkpoint
+		decoder.Offset = state.Offset()
+
+		// a state recorded for another file must not be resumed
+		header, err := decoder.ReadHeader()
+		if err == nil {
+			err = state.Start(header.Size)
+		}
+
+		if err != nil {
+			state.Close()
+			return err
+		}
+	}
+
+	_, err = io.Copy(outputFile, decoder)
+	if state == nil {
+		return err
+	}
+
+	if err != nil {
+		state.Close()
+		return err
+	}
+
+	return state.Remove()
+}
+
+// createOutput opens the output file. Existing files are truncated unless truncate is false, which
+// keeps the data of a previous transfer when resuming or when writing the ranges of a file separately
+func createOutput(outputFileName string, truncate bool) *os.File {
+	if outputFileName == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if outputFileName == "-" {
+		return os.Stdout
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	// block devices can't be truncated
+	info, err := os.Stat(outputFileName)
+	if truncate && (err != nil || !sparsecat.IsBlockDevice(info)) {
+		flags |= os.O_TRUNC
+	}
+
+	outputFile, err := os.OpenFile(outputFileName, flags, 0666)
+	if err != nil {
+		log.Fatalf("unable to create outputFile: %s", err)
+	}
+
+	return outputFile
+}
+
+// readKey reads the passphrase or key from a file. A trailing newline is not considered part of the key.
+func readKey(fileName string) []byte {
+	key, err := os.ReadFile(fileName)
+	if err != nil {
+		log.Fatalf("unable to read key: %s", err)
+	}
+
+	key = bytes.TrimRight(key, "\r\n")
+	if len(key) == 0 {
+		log.Fatalf("key file %s is empty", fileName)
+	}
+
+	return key
+}
+
+// parseHoleMode converts the value of a -holes flag to a HoleMode
+func parseHoleMode(name string) sparsecat.HoleMode {
+	switch name {
+	case "keep":
+		return sparsecat.HolesKeep
+	case "punch":
+		return sparsecat.HolesPunch
+	case "zero":
+		return sparsecat.HolesZero
+	case "discard":
+		return sparsecat.HolesDiscard
 	}
 
-	return inputFile, outputFile
+	log.Fatalf("invalid value %s for -holes", name)
+	return sparsecat.HolesKeep
 }
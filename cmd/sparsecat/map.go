@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/svenwiltink/sparsecat"
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// runMap implements the map command, which shows the sections that would be sent for a file
+func runMap(args []string) {
+	flags := flag.NewFlagSet("map", flag.ExitOnError)
+	inputFileName := flags.String("if", "", "the file to map")
+	formatName := flags.String("format", "rbd-diff-v1", "the wire format used to predict the size of the stream. "+formatNames)
+	compression := flags.String("compress", "", "predict the size of a stream compressed using gzip or flate. Only supported by the sparsecat-v1 format")
+	detectZeroBlocks := flags.Bool("detect-zero-blocks", false, "skip blocks that only contain zeros in addition to holes")
+	zeroBlockSize := flags.Int64("zero-block-size", 4096, "the block size used by -detect-zero-blocks")
+	offset := flags.Int64("offset", 0, "start mapping at this offset")
+	length := flags.Int64("length", 0, "only map this many bytes starting at -offset. 0 maps everything up to the end of the input")
+	rangeSize := flags.Bool("range-size", false, "predict the stream describing only the range selected by -offset and -length, as sent using -range-size")
+	jsonOutput := flags.Bool("json", false, "print the result as JSON")
+	_ = flags.Parse(args)
+
+	if *inputFileName == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	f := getFormat(*formatName, *compression)
+	checkZeroBlockSize(f, *zeroBlockSize)
+
+	inputFile, err := os.Open(*inputFileName)
+	if err != nil {
+		log.Fatalf("unable to open inputFile: %s", err)
+	}
+	defer inputFile.Close()
+
+	encoder := sparsecat.NewEncoder(inputFile)
+	encoder.Format = f
+	encoder.DetectZeroBlocks = *detectZeroBlocks
+	encoder.ZeroBlockSize = *zeroBlockSize
+	encoder.Offset = *offset
+	encoder.Length = *length
+	encoder.ReportRangeSize = *rangeSize
+
+	sourceMap, err := encoder.Map()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *jsonOutput {
+		printJSON(sourceMap)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "size:\t%s\n", formatBytes(sourceMap.Size))
+	fmt.Fprintf(writer, "sections:\t%d\n", len(sourceMap.Sections))
+	fmt.Fprintf(writer, "allocated:\t%s\n", formatBytes(sourceMap.AllocatedBytes))
+	fmt.Fprintf(writer, "data:\t%s\n", formatBytes(sourceMap.DataBytes))
+	fmt.Fprintf(writer, "stream size:\t%s\n", formatBytes(sourceMap.StreamSize))
+	_ = writer.Flush()
+
+	if len(sourceMap.Sections) == 0 {
+		return
+	}
+
+	fmt.Println()
+	printSections(sourceMap.Sections)
+}
+
+// getFormat returns the format with the given name, compressing sections when a codec is given
+func getFormat(formatName string, compression string) format.Format {
+	f, exists := format.GetByName(formatName)
+	if !exists {
+		log.Fatalf("Format %s doesn't exist", formatName)
+	}
+
+	if compression == "" {
+		return f
+	}
+
+	compressing, ok := f.(format.CompressingFormat)
+	if !ok {
+		log.Fatalf("Compression is not supported by format %s", formatName)
+	}
+
+	f, err := compressing.WithCodec(compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return f
+}
+
+// checkZeroBlockSize exits when the value of -zero-block-size can't be used with format f
+func checkZeroBlockSize(f format.Format, zeroBlockSize int64) {
+	if zeroBlockSize <= 0 {
+		log.Fatalf("invalid value %d for -zero-block-size", zeroBlockSize)
+	}
+
+	if limiter, ok := f.(format.SectionSizeLimiter); ok && limiter.MaxSectionSize() > 0 && zeroBlockSize > limiter.MaxSectionSize() {
+		log.Fatalf("-zero-block-size can't be larger than %d, the maximum section size of the format", limiter.MaxSectionSize())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/svenwiltink/sparsecat"
+)
+
+// runVerify implements the verify command, which compares a target file to a stream or source file
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	inputFileName := flags.String("if", "-", "the stream to compare the target to. '-' for stdin")
+	sourceFileName := flags.String("source", "", "compare the target to this source file instead of a stream")
+	targetFileName := flags.String("target", "", "the file to verify")
+	formatName := flags.String("format", "rbd-diff-v1", "the wire format of the stream. "+formatNames)
+	decryptKey := flags.String("decrypt-key", "", "decrypt the stream using the passphrase or key stored in this file")
+	offset := flags.Int64("offset", 0, "the offset the stream was sent from. Holes in front of it are not checked")
+	jsonOutput := flags.Bool("json", false, "print the result as JSON")
+	_ = flags.Parse(args)
+
+	if *targetFileName == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	f := getFormat(*formatName, "")
+
+	var stream io.Reader
+	if *sourceFileName != "" {
+		sourceFile, err := os.Open(*sourceFileName)
+		if err != nil {
+			log.Fatalf("unable to open source: %s", err)
+		}
+		defer sourceFile.Close()
+
+		encoder := sparsecat.NewEncoder(sourceFile)
+		encoder.Format = f
+		stream = encoder
+	} else {
+		stream = openInput(*inputFileName, *decryptKey)
+	}
+
+	targetFile, err := os.Open(*targetFileName)
+	if err != nil {
+		log.Fatalf("unable to open target: %s", err)
+	}
+	defer targetFile.Close()
+
+	decoder := sparsecat.NewDecoder(stream)
+	decoder.Format = f
+	decoder.Offset = *offset
+
+	result, err := decoder.Verify(targetFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *jsonOutput {
+		printJSON(struct {
+			*sparsecat.VerifyResult
+			Match bool `json:"match"`
+		}{result, result.Match()})
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(writer, "size:\t%s\n", formatBytes(result.Size))
+		if result.TargetSize >= 0 {
+			fmt.Fprintf(writer, "target size:\t%s\n", formatBytes(result.TargetSize))
+		}
+		fmt.Fprintf(writer, "data compared:\t%s\n", formatBytes(result.DataBytes))
+		fmt.Fprintf(writer, "holes checked:\t%s\n", formatBytes(result.HoleBytes))
+		fmt.Fprintf(writer, "mismatched:\t%s\n", formatBytes(result.MismatchedBytes))
+		if result.FirstMismatch >= 0 {
+			fmt.Fprintf(writer, "first mismatch:\t%d\n", result.FirstMismatch)
+		}
+		_ = writer.Flush()
+	}
+
+	if !result.Match() {
+		if !*jsonOutput {
+			fmt.Println("target does not match")
+		}
+		os.Exit(1)
+	}
+}
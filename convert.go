@@ -0,0 +1,168 @@
+package sparsecat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// maxBufferedSection is the largest section Convert verifies in memory, larger sections are spooled to a temporary
+// file
+const maxBufferedSection = 64 << 20
+
+// Convert reads a stream of format from and writes the same file to writer as a stream of format to. Sections
+// are copied one at a time without materialising the holes in between. Sections larger than to supports are split.
+// Snapshot names in the header are kept when both formats support them. When from verifies the data of its sections,
+// such as sparsecat-v1, every section is read and verified before it is written, so corrupt data doesn't end up in
+// the output with a fresh checksum. The digest of a stream can only be verified at its end, so on error the output
+// is incomplete and should be discarded.
+// The amount of bytes written to writer is returned.
+func Convert(writer io.Writer, stream io.Reader, from format.Format, to format.Format) (int64, error) {
+	from = format.ForStream(from)
+	to = format.ForStream(to)
+
+	header, err := format.ReadHeader(from, stream)
+	if err != nil {
+		return 0, fmt.Errorf("error reading file size: %w", err)
+	}
+
+	var maxSectionSize int64
+	if limiter, ok := to.(format.SectionSizeLimiter); ok {
+		maxSectionSize = limiter.MaxSectionSize()
+	}
+
+	var written int64
+	write := func(reader io.Reader, length int64) error {
+		copied, err := io.Copy(writer, reader)
+		written += copied
+		if err != nil {
+			return err
+		}
+
+		if copied != length {
+			return fmt.Errorf("read size doesn't equal section size. %d vs %d. %w", copied, length, io.ErrUnexpectedEOF)
+		}
+
+		return nil
+	}
+
+	err = write(format.GetHeaderReader(to, header))
+	if err != nil {
+		return written, fmt.Errorf("error writing file size: %w", err)
+	}
+
+	var position int64
+	for {
+		section, err := from.ReadSectionHeader(stream)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return written, err
+		}
+
+		if section.Offset < position {
+			return written, fmt.Errorf("section at offset %d is out of order", section.Offset)
+		}
+		position = section.Offset + section.Length
+
+		if section.Zero {
+			err = write(to.GetSectionReader(nil, section))
+			if err != nil {
+				return written, fmt.Errorf("error writing zero section at offset %d: %w", section.Offset, err)
+			}
+			continue
+		}
+
+		data := format.GetSectionDataReader(from, stream, section)
+
+		release := func() {}
+		if _, verifies := from.(format.SectionDataReader); verifies {
+			data, release, err = readVerifiedSection(data, section.Length)
+			if err != nil {
+				return written, fmt.Errorf("error reading section at offset %d: %w", section.Offset, err)
+			}
+		}
+
+		err = copySection(write, to, data, section, maxSectionSize)
+		release()
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	err = write(to.GetEndTagReader())
+	if err != nil {
+		return written, fmt.Errorf("error writing end tag: %w", err)
+	}
+
+	return written, nil
+}
+
+// copySection writes section as sections of to, splitting it when it is larger than maxSectionSize
+func copySection(write func(reader io.Reader, length int64) error, to format.Format, data io.Reader, section format.Section, maxSectionSize int64) error {
+	end := section.Offset + section.Length
+	for offset := section.Offset; offset < end; {
+		part := format.Section{Offset: offset, Length: end - offset}
+		if maxSectionSize > 0 && part.Length > maxSectionSize {
+			part.Length = maxSectionSize
+		}
+
+		err := write(to.GetSectionReader(io.LimitReader(data, part.Length), part))
+		if err != nil {
+			return fmt.Errorf("error writing section at offset %d: %w", part.Offset, err)
+		}
+
+		offset += part.Length
+	}
+
+	// drain the section so the source format can verify what follows the data, such as a checksum
+	_, err := io.Copy(io.Discard, data)
+	if err != nil {
+		return fmt.Errorf("error reading section at offset %d: %w", section.Offset, err)
+	}
+
+	return nil
+}
+
+// readVerifiedSection reads the entire data of a section, so the source format verifies it before any of it is
+// written. Sections up to maxBufferedSection bytes are kept in memory, larger ones are spooled to a temporary file.
+// release must be called once the returned reader isn't needed anymore.
+func readVerifiedSection(data io.Reader, length int64) (io.Reader, func(), error) {
+	if length <= maxBufferedSection {
+		buf, err := io.ReadAll(data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return bytes.NewReader(buf), func() {}, nil
+	}
+
+	spool, err := os.CreateTemp("", "sparsecat-convert-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+
+	release := func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}
+
+	_, err = io.Copy(spool, data)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	return spool, release, nil
+}
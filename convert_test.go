@@ -0,0 +1,198 @@
+package sparsecat
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+func TestConvert(t *testing.T) {
+	const kib = 1024
+
+	data := fill(fill(make([]byte, 64*kib), 0, 4*kib, 1), 8*kib, 8*kib, 2)
+	sections := []format.Section{
+		{Offset: 0, Length: 4 * kib},
+		{Offset: 8 * kib, Length: 8 * kib},
+		{Offset: 32 * kib, Length: 4 * kib, Zero: true},
+	}
+	header := format.Header{Size: 64 * kib, FromSnapshot: "snap1", ToSnapshot: "snap2"}
+
+	formats := []struct {
+		name   string
+		format format.Format
+	}{
+		{name: "rbd-diff-v1", format: format.RbdDiffv1},
+		{name: "rbd-diff-v2", format: format.RbdDiffv2},
+		{name: "rbd-export-v2", format: format.RbdExportv2},
+		{name: "sparsecat-v1", format: format.SparsecatV1},
+	}
+
+	for _, from := range formats {
+		for _, to := range formats {
+			t.Run(from.name+" to "+to.name, func(t *testing.T) {
+				stream := writeStream(t, from.format, header, sections, data)
+
+				var converted bytes.Buffer
+				written, err := Convert(&converted, bytes.NewReader(stream), from.format, to.format)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if written != int64(converted.Len()) {
+					t.Errorf("expected %d bytes to be reported, %d were written", converted.Len(), written)
+				}
+
+				info, err := Inspect(bytes.NewReader(converted.Bytes()), to.format)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(info.Sections, sections) {
+					t.Errorf("expected sections %+v, got %+v", sections, info.Sections)
+				}
+
+				// snapshot names are kept when both formats support them
+				expectedHeader := format.Header{Size: header.Size}
+				_, fromSnapshots := from.format.(format.HeaderFormat)
+				_, toSnapshots := to.format.(format.HeaderFormat)
+				if fromSnapshots && toSnapshots {
+					expectedHeader = header
+				}
+
+				if info.Header != expectedHeader {
+					t.Errorf("expected header %+v, got %+v", expectedHeader, info.Header)
+				}
+
+				decoder := NewDecoder(bytes.NewReader(converted.Bytes()))
+				decoder.Format = to.format
+
+				decoded, err := io.ReadAll(decoder)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(decoded, data) {
+					t.Error("converted stream doesn't contain the original file")
+				}
+
+				// converting back results in the original stream, apart from the snapshots that were lost
+				var back bytes.Buffer
+				_, err = Convert(&back, bytes.NewReader(converted.Bytes()), to.format, from.format)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(back.Bytes(), writeStream(t, from.format, expectedHeader, sections, data)) {
+					t.Error("converting back doesn't result in the original stream")
+				}
+			})
+		}
+	}
+}
+
+func TestConvertSplitsSections(t *testing.T) {
+	const kib = 1024
+
+	data := fill(fill(make([]byte, 64*kib), 0, 4*kib, 1), 8*kib, 8*kib, 2)
+	stream := writeStream(t, format.SparsecatV1, format.Header{Size: 64 * kib}, []format.Section{
+		{Offset: 0, Length: 4 * kib},
+		{Offset: 8 * kib, Length: 8 * kib},
+	}, data)
+
+	to := limitedFormat{Format: format.RbdDiffv1, maxSectionSize: 3000}
+
+	var converted bytes.Buffer
+	_, err := Convert(&converted, bytes.NewReader(stream), format.SparsecatV1, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := Inspect(bytes.NewReader(converted.Bytes()), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []format.Section{
+		{Offset: 0, Length: 3000},
+		{Offset: 3000, Length: 4*kib - 3000},
+		{Offset: 8 * kib, Length: 3000},
+		{Offset: 8*kib + 3000, Length: 3000},
+		{Offset: 8*kib + 6000, Length: 8*kib - 6000},
+	}
+
+	if !reflect.DeepEqual(info.Sections, expected) {
+		t.Errorf("expected sections %+v, got %+v", expected, info.Sections)
+	}
+
+	decoded, err := io.ReadAll(NewDecoder(bytes.NewReader(converted.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decoded, data) {
+		t.Error("converted stream doesn't contain the original file")
+	}
+}
+
+func TestConvertRejects(t *testing.T) {
+	const kib = 1024
+
+	data := fill(make([]byte, 64*kib), 0, 16*kib, 1)
+
+	tests := []struct {
+		name   string
+		format format.Format
+		stream []byte
+	}{
+		{
+			name:   "out of order",
+			format: format.RbdDiffv1,
+			stream: writeStream(t, format.RbdDiffv1, format.Header{Size: 64 * kib}, []format.Section{
+				{Offset: 8 * kib, Length: 4 * kib},
+				{Offset: 0, Length: 4 * kib},
+			}, data),
+		},
+		{
+			name:   "overlapping",
+			format: format.RbdDiffv2,
+			stream: writeStream(t, format.RbdDiffv2, format.Header{Size: 64 * kib}, []format.Section{
+				{Offset: 0, Length: 8 * kib},
+				{Offset: 4 * kib, Length: 4 * kib, Zero: true},
+			}, data),
+		},
+		{
+			name:   "truncated",
+			format: format.RbdDiffv1,
+			stream: writeStream(t, format.RbdDiffv1, format.Header{Size: 64 * kib}, []format.Section{{Offset: 0, Length: 4 * kib}}, data)[:100],
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Convert(io.Discard, bytes.NewReader(test.stream), test.format, format.SparsecatV1)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	corrupt := writeStream(t, format.SparsecatV1, format.Header{Size: 64 * kib}, []format.Section{{Offset: 0, Length: 4 * kib}}, data)
+	// flip a byte of the data of the first section, which follows the header and the section header
+	corrupt[len("sparsecat v1\n")+1+8+1+8+8+100] ^= 1
+
+	// corrupt data is verified before it is written, so only the header ends up in the output
+	var converted bytes.Buffer
+	_, err := Convert(&converted, bytes.NewReader(corrupt), format.SparsecatV1, format.RbdDiffv1)
+	if err == nil {
+		t.Fatal("expected an error converting corrupt data")
+	}
+
+	header, _ := format.RbdDiffv1.GetFileSizeReader(64 * kib)
+	expected, _ := io.ReadAll(header)
+	if !bytes.Equal(converted.Bytes(), expected) {
+		t.Errorf("expected only the header to be written, got %d bytes", converted.Len())
+	}
+}
@@ -1,6 +1,7 @@
 package sparsecat
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/svenwiltink/sparsecat/format"
@@ -8,6 +9,12 @@ import (
 	"os"
 )
 
+// ErrSnapshotMismatch is returned when a diff doesn't start at the snapshot set in Decoder.FromSnapshot.
+var ErrSnapshotMismatch = errors.New("diff doesn't start at the expected snapshot")
+
+// ErrFileTooLarge is returned when a stream declares a file larger than Decoder.MaxFileSize.
+var ErrFileTooLarge = errors.New("file too large")
+
 type onlyReader struct {
 	io.Reader
 }
@@ -34,7 +41,31 @@ type Decoder struct {
 	DisableSparseWriting bool
 	DisableFileTruncate  bool
 
+	// HoleMode determines what WriteToAt does with the holes of the file. When writing over an existing target
+	// that isn't truncated first, HolesPunch or HolesZero is needed to get rid of the old data in the holes. Any
+	// other mode than HolesKeep also resizes the target to the size of the file, even when DisableFileTruncate has
+	// been set.
+	HoleMode HoleMode
+	// Offset is the offset the stream was encoded from using Encoder.Offset. Holes in front of it are not cleared.
+	Offset int64
+
+	// Checkpoint is called by WriteTo every time a data section has been written completely. The offset
+	// is the end of that section. Everything in front of it has been written to the target and the transfer
+	// can be resumed from there by setting Encoder.Offset. Offset and Checkpoint require a target WriteToAt can
+	// write to, Read writes the file from the start.
+	Checkpoint func(offset int64) error
+
+	// FromSnapshot requires the stream to be a diff starting at this snapshot, so a chain of diffs can be checked
+	// for gaps. Empty accepts any stream.
+	FromSnapshot string
+
+	// MaxFileSize rejects streams declaring a larger file size in their header, before anything is written to the
+	// target. Zero means there is no limit.
+	MaxFileSize int64
+
 	reader io.Reader
+	stream format.Format
+	header format.Header
 
 	fileSize      int64
 	currentOffset int64
@@ -50,10 +81,11 @@ type Decoder struct {
 func (d *Decoder) Read(p []byte) (int, error) {
 	var err error
 	if d.currentSection == nil {
-		d.fileSize, err = d.Format.ReadFileSize(d.reader)
+		err = d.readHeader()
 		if err != nil {
-			return 0, fmt.Errorf("error determining target file size: %w", err)
+			return 0, err
 		}
+		d.fileSize = d.header.Size
 
 		err = d.parseSection()
 		if err != nil {
@@ -90,8 +122,53 @@ func (d *Decoder) Read(p []byte) (int, error) {
 	return read, err
 }
 
+// ReadHeader reads the header of the stream before decoding it, for example to check the stream is of the expected
+// file. Decoding continues after the header.
+func (d *Decoder) ReadHeader() (format.Header, error) {
+	err := d.readHeader()
+	return d.header, err
+}
+
+// readHeader reads the header of the stream, unless that has been done already, and checks it starts at FromSnapshot
+func (d *Decoder) readHeader() error {
+	if d.stream != nil {
+		return nil
+	}
+
+	stream := format.ForStream(d.Format)
+
+	var err error
+	d.header, err = format.ReadHeader(stream, d.reader)
+	if err != nil {
+		return fmt.Errorf("error determining target file size: %w", err)
+	}
+	d.stream = stream
+
+	if d.MaxFileSize > 0 && d.header.Size > d.MaxFileSize {
+		return fmt.Errorf("%w: the stream declares a file of %d bytes, at most %d bytes are allowed", ErrFileTooLarge, d.header.Size, d.MaxFileSize)
+	}
+
+	if d.FromSnapshot != "" && d.header.FromSnapshot != d.FromSnapshot {
+		return fmt.Errorf("%w: expected %q but the diff starts at %q", ErrSnapshotMismatch, d.FromSnapshot, d.header.FromSnapshot)
+	}
+
+	return nil
+}
+
+// Header returns the header of the stream, including the snapshots of a diff. It is available once decoding has
+// started. For streams containing several diffs, ToSnapshot is the snapshot of the last diff read so far, so after
+// decoding the header describes the stream as a whole.
+func (d *Decoder) Header() format.Header {
+	header := d.header
+	if chain, ok := d.stream.(format.DiffChainFormat); ok {
+		header.ToSnapshot = chain.LastHeader().ToSnapshot
+	}
+
+	return header
+}
+
 func (d *Decoder) parseSection() error {
-	section, err := d.Format.ReadSectionHeader(d.reader)
+	section, err := d.stream.ReadSectionHeader(d.reader)
 	if errors.Is(err, io.EOF) {
 		d.currentSectionLength = d.fileSize - d.currentOffset
 		d.currentSection = io.LimitReader(zeroReader{}, d.currentSectionLength)
@@ -103,49 +180,134 @@ func (d *Decoder) parseSection() error {
 		return err
 	}
 
+	err = d.checkSection(section)
+	if err != nil {
+		return err
+	}
+
+	// the output is written sequentially, so it can't go back to an earlier offset like multi-diff streams do
+	if section.Offset < d.currentOffset {
+		return fmt.Errorf("section at offset %d is out of order, the output is already at offset %d. Streams containing several diffs must be written to a seekable file", section.Offset, d.currentOffset)
+	}
+
 	padding := section.Offset - d.currentOffset
 	d.currentSectionLength = padding + section.Length
 
 	paddingReader := io.LimitReader(zeroReader{}, padding)
-	dataReader := io.LimitReader(d.reader, section.Length)
+	dataReader := format.GetSectionDataReader(d.stream, d.reader, section)
+	if section.Zero {
+		dataReader = io.LimitReader(zeroReader{}, section.Length)
+	}
 	d.currentSection = io.MultiReader(paddingReader, dataReader)
 
 	return nil
 }
 
-// WriteTo is the fast path optimisation of Decoder.Read. If the target of io.Copy is an *os.File that is
-// capable of seeking WriteTo will be used. It preserves the sparseness of the target file and does not need
-// to write the entire file. Only section of the file containing data will be written. When s.DisableSparseWriting
-// has been set this falls back to io.Copy with only the s.Read function exposed. When s.DisableFileTruncate has
-// been set the output file will not be truncated prior to writing to it
+// Truncater can be implemented by the target of a Decoder to have it resized to the size of the decoded file. Only
+// the data of the file is written to such targets, so like a file created for the transfer they must read as zeros
+// where the file has holes, unless HoleMode is set.
+type Truncater interface {
+	Truncate(size int64) error
+}
+
+// WriteTo is the fast path optimisation of Decoder.Read. If the target of io.Copy is an *os.File that is capable of
+// seeking and wasn't opened using O_APPEND, WriteTo will be used. It preserves the sparseness of the target file and
+// does not need to write the entire file. Only section of the file containing data will be written. Other
+// io.WriterAt targets are only written this way when they implement Truncater or HoleMode has been set, as the
+// holes of the file are never written to them otherwise; the data they contain there would survive. When
+// s.DisableSparseWriting has been set this falls back to io.Copy with only the s.Read function exposed. When
+// s.DisableFileTruncate has been set the output file will not be truncated prior to writing to it
 func (d *Decoder) WriteTo(writer io.Writer) (int64, error) {
-	if d.DisableSparseWriting {
-		return io.Copy(writer, onlyReader{d})
-	}
+	target, ok := d.writerAt(writer)
+	if d.DisableSparseWriting || !ok {
+		// Read writes the file from the start, which would overwrite the data in front of Offset with zeros
+		if d.Offset != 0 || d.Checkpoint != nil {
+			return 0, errors.New("resuming requires a seekable target file and can't be combined with DisableSparseWriting")
+		}
 
-	file, isFile := d.isSeekableFile(writer)
-	if !isFile {
 		return io.Copy(writer, onlyReader{d})
 	}
 
-	size, err := d.Format.ReadFileSize(d.reader)
+	return d.WriteToAt(target)
+}
+
+// WriteToAt writes the decoded file to target. Only the sections containing data are written, so target must
+// already contain zeros where the file has holes unless HoleMode is set. When target implements Truncater it is
+// resized to the size of the file first, unless DisableFileTruncate has been set. Other targets must be large enough
+// to hold the file. Block devices can't be truncated, instead their size is checked and their holes are zeroed
+// unless DisableFileTruncate or another HoleMode has been set.
+func (d *Decoder) WriteToAt(target io.WriterAt) (int64, error) {
+	return d.writeToAt(target, false)
+}
 
+// ApplyTo writes a diff, such as created by rbd export-diff, on top of the existing content of target. Unlike
+// WriteToAt the holes of the stream are left alone, as they are the parts of the image that haven't changed. Data
+// sections are written and zero sections are cleared according to HoleMode, punching holes by default. Files are
+// resized to the size of the stream unless DisableFileTruncate has been set, block devices must be large enough.
+func (d *Decoder) ApplyTo(target io.WriterAt) (int64, error) {
+	return d.writeToAt(target, true)
+}
+
+// writeToAt implements WriteToAt and ApplyTo. When apply is set the holes of the stream are not cleared
+func (d *Decoder) writeToAt(target io.WriterAt, apply bool) (int64, error) {
+	err := d.readHeader()
 	if err != nil {
-		return 0, fmt.Errorf("error determining target file size: %w", err)
+		return 0, err
+	}
+
+	size := d.header.Size
+	holes := holeClearer{target: target, mode: d.HoleMode}
+	truncate := !d.DisableFileTruncate
+
+	// clearing the holes makes the target an exact copy, so data beyond the end of the file has to go as well.
+	// Resizing the target keeps the data in front of it.
+	if holes.mode != HolesKeep && !apply {
+		truncate = true
 	}
 
-	if !d.DisableFileTruncate {
-		err = SparseTruncate(file, size)
+	if file, isFile := target.(*os.File); isFile {
+		holes.blockDevice, holes.sectorSize, err = openBlockDeviceTarget(file, size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if holes.blockDevice != nil {
+		// zeroing the holes of a block device takes the place of truncating it
+		if truncate && holes.mode == HolesKeep && !apply {
+			holes.mode = HolesZero
+		}
+		truncate = false
+	}
+
+	// zero sections must always be cleared, the target may contain data there
+	zeros := holes
+	if zeros.mode == HolesKeep {
+		zeros.mode = HolesPunch
+	}
+
+	if apply {
+		holes.mode = HolesKeep
+	}
+
+	if truncate {
+		err = truncateTarget(target, size)
 		if err != nil {
 			return 0, fmt.Errorf("error truncating target file: %w", err)
 		}
 	}
 
 	var written int64 = 0
+	position := d.Offset
 
 	for {
-		section, err := d.Format.ReadSectionHeader(d.reader)
+		section, err := d.stream.ReadSectionHeader(d.reader)
 		if errors.Is(err, io.EOF) {
+			err = holes.clear(position, size-position)
+			if err != nil {
+				return written, fmt.Errorf("error clearing hole: %w", err)
+			}
+
 			return written, nil
 		}
 
@@ -153,75 +315,260 @@ func (d *Decoder) WriteTo(writer io.Writer) (int64, error) {
 			return written, err
 		}
 
-		_, err = file.Seek(section.Offset, io.SeekStart)
+		err = d.checkSection(section)
+		if err != nil {
+			return written, err
+		}
+
+		err = holes.clear(position, section.Offset-position)
 		if err != nil {
-			return written, fmt.Errorf("error seeking to start of data section: %w", err)
+			return written, fmt.Errorf("error clearing hole: %w", err)
 		}
 
-		copied, err := io.Copy(writer, io.LimitReader(d.reader, section.Length))
+		// streams containing multiple diffs may go back to an earlier offset, which has been cleared already
+		if section.Offset+section.Length > position {
+			position = section.Offset + section.Length
+		}
+
+		if section.Zero {
+			err = zeros.clear(section.Offset, section.Length)
+			if err != nil {
+				return written, fmt.Errorf("error clearing zero section: %w", err)
+			}
+
+			err = d.checkpoint(section)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		copied, err := io.Copy(&offsetWriter{target: target, offset: section.Offset}, format.GetSectionDataReader(d.stream, d.reader, section))
 		written += copied
 		if err != nil {
 			return written, fmt.Errorf("error copying data: %w", err)
 		}
+
+		if copied != section.Length {
+			return written, fmt.Errorf("read size doesn't equal section size. %d vs %d. %w", copied, section.Length, io.ErrUnexpectedEOF)
+		}
+
+		err = d.checkpoint(section)
+		if err != nil {
+			return written, err
+		}
 	}
 }
 
+// checkSection rejects sections that don't fit in the file declared by the stream, before anything is written for
+// them. Streams containing several diffs are checked against the size of the diff the section belongs to.
+func (d *Decoder) checkSection(section format.Section) error {
+	size := d.header.Size
+	if chain, ok := d.stream.(format.DiffChainFormat); ok {
+		size = chain.LastHeader().Size
+	}
+
+	if section.Offset < 0 || section.Length < 0 || section.Offset > size-section.Length {
+		return fmt.Errorf("section at offset %d with length %d doesn't fit in a file of %d bytes", section.Offset, section.Length, size)
+	}
+
+	return nil
+}
+
+// checkpoint reports that section has been written completely
+func (d *Decoder) checkpoint(section format.Section) error {
+	if d.Checkpoint == nil {
+		return nil
+	}
+
+	err := d.Checkpoint(section.Offset + section.Length)
+	if err != nil {
+		return fmt.Errorf("error recording checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// writerAt returns the io.WriterAt of writer when it can be used by WriteToAt. WriteToAt only writes the data of
+// the file, so other targets than files are only used when they implement Truncater, which is expected to clear
+// them like truncating a file does, or when HoleMode clears the holes.
+func (d *Decoder) writerAt(writer io.Writer) (io.WriterAt, bool) {
+	if _, isFile := writer.(*os.File); isFile {
+		return d.isSeekableFile(writer)
+	}
+
+	target, ok := writer.(io.WriterAt)
+	if !ok {
+		return nil, false
+	}
+
+	if _, truncates := writer.(Truncater); truncates || d.HoleMode != HolesKeep {
+		return target, true
+	}
+
+	return nil, false
+}
+
 func (d *Decoder) isSeekableFile(writer io.Writer) (*os.File, bool) {
 	file, isFile := writer.(*os.File)
 	if isFile {
 		// not all files are actually seekable. pipes aren't for example
 		_, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, false
+		}
+
+		// files opened using O_APPEND don't support WriteAt. Writing nothing only checks for that
+		_, err = file.WriteAt(nil, 0)
 		return file, err == nil
 	}
 	return nil, false
 }
 
+// openBlockDeviceTarget returns file and its sector size when it is a block device. An error is returned when the
+// block device is too small to hold a file of size bytes. Character devices are left alone, the ioctls used to
+// clear holes only work for block devices.
+func openBlockDeviceTarget(file *os.File, size int64) (*os.File, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error running stat: %w", err)
+	}
+
+	if !IsBlockDevice(info) || info.Mode()&os.ModeCharDevice != 0 {
+		return nil, 0, nil
+	}
+
+	deviceSize, err := getBlockDeviceSize(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error determining size of block device: %w", err)
+	}
+
+	if int64(deviceSize) < size {
+		return nil, 0, fmt.Errorf("block device of %d bytes is too small for a file of %d bytes", deviceSize, size)
+	}
+
+	sectorSize, err := getBlockDeviceSectorSize(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error determining sector size of block device: %w", err)
+	}
+
+	if sectorSize <= 0 {
+		sectorSize = 512
+	}
+
+	return file, int64(sectorSize), nil
+}
+
+// truncateTarget resizes target to size when it supports it. Files are truncated sparsely, devices are skipped.
+func truncateTarget(target io.WriterAt, size int64) error {
+	switch target := target.(type) {
+	case *os.File:
+		info, err := target.Stat()
+		if err != nil {
+			return err
+		}
+
+		if IsBlockDevice(info) {
+			return nil
+		}
+
+		return SparseTruncate(target, size)
+	case Truncater:
+		return target.Truncate(size)
+	}
+
+	return nil
+}
+
+// offsetWriter writes to target sequentially, starting at offset
+type offsetWriter struct {
+	target io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	written, err := o.target.WriteAt(p, o.offset)
+	o.offset += int64(written)
+	return written, err
+}
+
 func NewEncoder(file *os.File) *Encoder {
-	return &Encoder{file: file, Format: format.RbdDiffv1, MaxSectionSize: 1 << 32}
+	return &Encoder{file: file, reader: file, Format: format.RbdDiffv1, MaxSectionSize: 1 << 32, ZeroBlockSize: 4096}
+}
+
+// NewReaderAtEncoder creates an Encoder for sources that aren't an *os.File, such as an in-memory image or
+// an io.SectionReader. When reader implements ExtentReporter it is used to skip holes, otherwise the content
+// of the reader is scanned for zero blocks instead.
+func NewReaderAtEncoder(reader io.ReaderAt, size int64) *Encoder {
+	reporter, ok := reader.(ExtentReporter)
+	if !ok {
+		return NewExtentEncoder(reader, NewZeroScanSource(size))
+	}
+
+	return NewExtentEncoder(reader, reportedExtents{ExtentReporter: reporter, size: size})
+}
+
+// NewExtentEncoder creates an Encoder that reads data from reader and uses extents to determine which parts
+// of the reader contain data.
+func NewExtentEncoder(reader io.ReaderAt, extents ExtentSource) *Encoder {
+	return &Encoder{reader: reader, extents: extents, Format: format.RbdDiffv1, MaxSectionSize: 1 << 32, ZeroBlockSize: 4096}
 }
 
 // Encoder encodes a file to a stream of sparsecat data.
 type Encoder struct {
-	file *os.File
+	file    *os.File
+	reader  io.ReaderAt
+	extents ExtentSource
+	stream  format.Format
 
 	Format         format.Format
 	MaxSectionSize int64
 
-	fileSize int64
+	// Offset is the position in the source at which encoding starts. Data in front of it is not sent, which allows
+	// resuming an interrupted transfer from the last checkpoint of the Decoder.
+	Offset int64
+	// Length limits the encoded data to the range starting at Offset. Zero means up to the end of the source.
+	Length int64
+	// ReportRangeSize makes the stream describe only the range selected by Offset and Length, as if it were a file
+	// of its own: the size header contains the size of the range and sections start relative to Offset. By default
+	// the size of the whole source is reported and offsets are absolute, so the streams of several ranges can be
+	// written to the same target.
+	ReportRangeSize bool
+
+	// DetectZeroBlocks enables scanning the data sections of the file for blocks that only contain zeros. These
+	// blocks are skipped just like holes are. This is useful for images where zeros have been written over
+	// freed space, at the cost of inspecting every byte of the file.
+	DetectZeroBlocks bool
+	// ZeroBlockSize is the granularity in bytes that DetectZeroBlocks uses to find zero blocks. It can't be larger
+	// than MaxSectionSize or the maximum section size of Format.
+	ZeroBlockSize int64
+
+	fileSize       int64
+	rangeEnd       int64
+	scanForZeros   bool
+	scanBlockSize  int64
+	maxSectionSize int64
+
+	scanBuffer []byte
+	scanData   []byte
+	scanOffset int64
 
 	currentOffset        int64
 	currentSection       io.Reader
+	currentSectionInfo   format.Section
 	currentSectionLength int64
 	currentSectionEnd    int64
 	currentSectionRead   int
 
-	supportsHoleDetection bool
-
 	done bool
 }
 
 func (e *Encoder) Read(p []byte) (int, error) {
 	if e.currentSection == nil {
-		info, err := e.file.Stat()
+		err := e.start()
 		if err != nil {
-			return 0, fmt.Errorf("error running stat: %w", err)
+			return 0, err
 		}
-
-		size := uint64(info.Size())
-
-		if isBlockDevice(info) {
-			e.supportsHoleDetection = false
-			bsize, err := getBlockDeviceSize(e.file)
-			if err != nil {
-				return 0, fmt.Errorf("error determining size of block device: %w", err)
-			}
-
-			size = uint64(bsize)
-		} else {
-			e.supportsHoleDetection = supportsSeekHole(e.file)
-		}
-
-		e.currentSection, e.currentSectionLength = e.Format.GetFileSizeReader(size)
 	}
 
 	read, err := e.currentSection.Read(p)
@@ -252,63 +599,274 @@ func (e *Encoder) Read(p []byte) (int, error) {
 	return read, err
 }
 
-func (e *Encoder) parseSection() error {
-	if !e.supportsHoleDetection {
-		return e.slowDetectSection()
+// start inspects the source and makes the size header the current section of the stream
+func (e *Encoder) start() error {
+	err := e.inspectSource()
+	if err != nil {
+		return err
 	}
 
-	start, end, err := detectDataSection(e.file, e.currentOffset)
-	if errors.Is(err, io.EOF) {
-		e.currentSection, e.currentSectionLength = e.Format.GetEndTagReader()
-		e.done = true
-		return nil
+	e.stream = format.ForStream(e.Format)
+	e.currentSectionEnd = e.Offset
+
+	// the format may not be able to handle sections as large as requested
+	e.maxSectionSize = e.MaxSectionSize
+	if limiter, ok := e.stream.(format.SectionSizeLimiter); ok {
+		limit := limiter.MaxSectionSize()
+		if limit > 0 && limit < e.maxSectionSize {
+			e.maxSectionSize = limit
+		}
+	}
+
+	e.currentSection, e.currentSectionLength = e.stream.GetFileSizeReader(uint64(e.reportedSize()))
+	return nil
+}
+
+// reportedSize returns the file size written to the stream
+func (e *Encoder) reportedSize() int64 {
+	if e.ReportRangeSize {
+		return e.rangeEnd - e.Offset
+	}
+
+	return e.fileSize
+}
+
+// inspectSource determines the size of the source and how to detect the data in it.
+func (e *Encoder) inspectSource() error {
+	if e.extents == nil {
+		extents, err := NewFileExtentSource(e.file)
+		if err != nil {
+			return fmt.Errorf("error determining extent source: %w", err)
+		}
+
+		e.extents = extents
 	}
 
+	size, err := e.extents.Size()
 	if err != nil {
-		return fmt.Errorf("error detecting data section: %w", err)
+		return fmt.Errorf("error determining size of source: %w", err)
 	}
 
-	length := end - start
+	e.fileSize = size
+	if scan, ok := e.extents.(zeroScanSource); ok {
+		e.scanForZeros = true
+		e.scanBlockSize = scan.blockSize
+	}
 
-	if length > e.MaxSectionSize {
-		end = start + e.MaxSectionSize
-		length = e.MaxSectionSize
+	if e.Offset < 0 || e.Offset > size {
+		return fmt.Errorf("offset %d is outside of the source of %d bytes", e.Offset, size)
 	}
 
-	e.currentSectionEnd = end
+	if e.Length < 0 {
+		return fmt.Errorf("invalid length %d", e.Length)
+	}
+
+	e.rangeEnd = size
+	if e.Length > 0 && e.Length < size-e.Offset {
+		e.rangeEnd = e.Offset + e.Length
+	}
 
-	_, err = e.file.Seek(start, io.SeekStart)
+	return nil
+}
+
+// nextExtent returns the next extent containing data, limited to the range being encoded.
+func (e *Encoder) nextExtent() (start, end int64, err error) {
+	start, end, err = e.extents.NextExtent(e.currentOffset)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	e.currentSection, e.currentSectionLength = e.Format.GetSectionReader(e.file, format.Section{
-		Offset: start,
-		Length: length,
-	})
+	if start >= e.rangeEnd {
+		return 0, 0, io.EOF
+	}
 
-	return nil
+	if end > e.rangeEnd {
+		end = e.rangeEnd
+	}
+
+	return start, end, nil
+}
+
+// startSection makes section of the source the current section of the stream
+func (e *Encoder) startSection(source io.Reader, section format.Section) {
+	e.currentSectionInfo = e.outputSection(section)
+	e.currentSection, e.currentSectionLength = e.stream.GetSectionReader(source, e.currentSectionInfo)
+}
+
+// outputSection translates a section of the source to the section that is written to the stream.
+func (e *Encoder) outputSection(section format.Section) format.Section {
+	if e.ReportRangeSize {
+		section.Offset -= e.Offset
+	}
+
+	return section
 }
 
-func (e *Encoder) slowDetectSection() error {
-	start, end, reader, err := slowDetectDataSection(e.file, e.currentOffset)
+func (e *Encoder) parseSection() error {
+	if e.DetectZeroBlocks || e.scanForZeros {
+		return e.scanSection()
+	}
+
+	start, end, err := e.nextExtent()
 	if errors.Is(err, io.EOF) {
-		e.currentSection, e.currentSectionLength = e.Format.GetEndTagReader()
+		e.currentSection, e.currentSectionLength = e.stream.GetEndTagReader()
 		e.done = true
 		return nil
 	}
 
 	if err != nil {
-		return fmt.Errorf("error detecting data section for block device: %w", err)
+		return fmt.Errorf("error detecting data section: %w", err)
 	}
 
 	length := end - start
+
+	if length > e.maxSectionSize {
+		end = start + e.maxSectionSize
+		length = e.maxSectionSize
+	}
+
 	e.currentSectionEnd = end
 
-	e.currentSection, e.currentSectionLength = e.Format.GetSectionReader(reader, format.Section{
+	e.startSection(io.NewSectionReader(e.reader, start, length), format.Section{
 		Offset: start,
 		Length: length,
 	})
 
 	return nil
 }
+
+// scanSection detects the next data section while skipping both holes and blocks that only contain zeros.
+func (e *Encoder) scanSection() error {
+	if e.zeroBlockSize() <= 0 {
+		return fmt.Errorf("invalid zero block size %d", e.zeroBlockSize())
+	}
+
+	// a single block containing data would otherwise become a section larger than the format allows
+	if e.zeroBlockSize() > e.maxSectionSize {
+		return fmt.Errorf("zero block size %d is larger than the maximum section size %d", e.zeroBlockSize(), e.maxSectionSize)
+	}
+
+	for {
+		start, end, err := e.nextExtent()
+		if errors.Is(err, io.EOF) {
+			e.currentSection, e.currentSectionLength = e.stream.GetEndTagReader()
+			e.done = true
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("error detecting data section: %w", err)
+		}
+
+		section, data, next, err := e.scanZeroBlocks(start, end)
+		if err != nil {
+			return fmt.Errorf("error scanning for zero blocks: %w", err)
+		}
+
+		// the entire extent only contained zeros, continue with the next one
+		if section.Length == 0 {
+			e.currentOffset = next
+			continue
+		}
+
+		e.currentSectionEnd = next
+		e.startSection(bytes.NewReader(data), section)
+		return nil
+	}
+}
+
+// scanZeroBlocks reads the extent between start and end and skips any leading blocks that only contain zeros.
+// The first run of data blocks is returned together with the offset at which scanning stopped. A section is never
+// larger than the scan buffer. When the extent only contains zeros an empty section is returned.
+func (e *Encoder) scanZeroBlocks(start, end int64) (section format.Section, data []byte, next int64, err error) {
+	offset := start
+	for offset < end {
+		buf, err := e.readScanBuffer(offset, end)
+		if err != nil {
+			return format.Section{}, nil, 0, err
+		}
+
+		// the file shrunk while reading it
+		if len(buf) == 0 {
+			break
+		}
+
+		dataStart, dataEnd := findDataBlocks(buf, int(e.zeroBlockSize()))
+		if dataStart == dataEnd {
+			offset += int64(len(buf))
+			continue
+		}
+
+		section = format.Section{
+			Offset: offset + int64(dataStart),
+			Length: int64(dataEnd - dataStart),
+		}
+
+		return section, buf[dataStart:dataEnd], offset + int64(dataEnd), nil
+	}
+
+	return format.Section{}, nil, end, nil
+}
+
+// readScanBuffer returns the data between offset and end, limited to the size of the scan buffer. Data that
+// has been read by a previous call is reused so a buffer containing multiple sections is only read once.
+func (e *Encoder) readScanBuffer(offset, end int64) ([]byte, error) {
+	if offset >= e.scanOffset && offset < e.scanOffset+int64(len(e.scanData)) {
+		buf := e.scanData[offset-e.scanOffset:]
+		if int64(len(buf)) > end-offset {
+			buf = buf[:end-offset]
+		}
+		return buf, nil
+	}
+
+	if e.scanBuffer == nil {
+		e.scanBuffer = make([]byte, e.scanBufferSize())
+	}
+
+	size := int64(len(e.scanBuffer))
+	if size > end-offset {
+		size = end - offset
+	}
+
+	read, err := e.reader.ReadAt(e.scanBuffer[:size], offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	e.scanOffset = offset
+	e.scanData = e.scanBuffer[:read]
+
+	return e.scanData, nil
+}
+
+// scanBufferSize returns the size of the buffer used for zero block detection. It is a multiple of
+// the zero block size and, when possible, no larger than the maximum section size.
+func (e *Encoder) scanBufferSize() int64 {
+	blockSize := e.zeroBlockSize()
+
+	size := int64(BLK_READ_BUFFER)
+	if size > e.maxSectionSize {
+		size = e.maxSectionSize
+	}
+
+	size -= size % blockSize
+	if size < blockSize {
+		size = blockSize
+	}
+
+	return size
+}
+
+// zeroBlockSize returns the granularity of zero block detection. Sources that scan at their own granularity, such
+// as block devices, use it unless DetectZeroBlocks has been set.
+func (e *Encoder) zeroBlockSize() int64 {
+	if e.DetectZeroBlocks || e.scanBlockSize == 0 {
+		return e.ZeroBlockSize
+	}
+
+	if e.scanBlockSize > e.maxSectionSize {
+		return e.maxSectionSize
+	}
+
+	return e.scanBlockSize
+}
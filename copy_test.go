@@ -0,0 +1,361 @@
+package sparsecat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// limitedFormat is the default format with a small maximum section size
+type limitedFormat struct {
+	format.Format
+	maxSectionSize int64
+}
+
+func (l limitedFormat) MaxSectionSize() int64 {
+	return l.maxSectionSize
+}
+
+func TestScanZeroBlocks(t *testing.T) {
+	data := fill(fill(fill(make([]byte, 64*1024), 5000, 3000, 1), 20000, 1, 2), 40000, 20000, 3)
+
+	tests := []struct {
+		name       string
+		start, end int64
+		// bufferSize limits the size of the scan buffer using the maximum section size
+		bufferSize int64
+		expected   format.Section
+		next       int64
+	}{
+		{
+			name:     "first run of data blocks",
+			start:    0,
+			end:      int64(len(data)),
+			expected: format.Section{Offset: 4096, Length: 4096},
+			next:     8192,
+		},
+		{
+			name:     "unaligned start",
+			start:    6000,
+			end:      int64(len(data)),
+			expected: format.Section{Offset: 6000, Length: 4096},
+			next:     10096,
+		},
+		{
+			name:  "end of the extent",
+			start: 16384,
+			end:   20001,
+			// blocks are counted from the start of the extent
+			expected: format.Section{Offset: 16384, Length: 3617},
+			next:     20001,
+		},
+		{
+			name:  "only zeros",
+			start: 8192,
+			end:   20000,
+			next:  20000,
+		},
+		{
+			name:  "limited by the scan buffer",
+			start: 36864,
+			end:   int64(len(data)),
+			// the data continues up to 60000 but only 8192 bytes are read at a time
+			bufferSize: 8192,
+			expected:   format.Section{Offset: 36864, Length: 8192},
+			next:       45056,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := NewReaderAtEncoder(bytes.NewReader(data), int64(len(data)))
+			encoder.maxSectionSize = encoder.MaxSectionSize
+			if test.bufferSize > 0 {
+				encoder.maxSectionSize = test.bufferSize
+			}
+
+			section, buf, next, err := encoder.scanZeroBlocks(test.start, test.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if section != test.expected {
+				t.Errorf("expected section %+v, got %+v", test.expected, section)
+			}
+
+			if next != test.next {
+				t.Errorf("expected scanning to stop at %d, got %d", test.next, next)
+			}
+
+			if !bytes.Equal(buf, data[section.Offset:section.Offset+section.Length]) {
+				t.Error("returned data doesn't match the source")
+			}
+		})
+	}
+}
+
+func TestEncoderMaxSectionSize(t *testing.T) {
+	data := fill(make([]byte, 64*1024), 0, 64*1024, 1)
+
+	tests := []struct {
+		name             string
+		detectZeroBlocks bool
+		zeroBlockSize    int64
+		fails            bool
+	}{
+		{name: "holes only", zeroBlockSize: 65536},
+		{name: "zero blocks", detectZeroBlocks: true, zeroBlockSize: 1024},
+		{name: "zero block larger than a section", detectZeroBlocks: true, zeroBlockSize: 65536, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := NewExtentEncoder(bytes.NewReader(data), NewExtentListSource(int64(len(data)), []Extent{{0, int64(len(data))}}))
+			encoder.Format = limitedFormat{Format: format.RbdDiffv1, maxSectionSize: 4096}
+			encoder.DetectZeroBlocks = test.detectZeroBlocks
+			encoder.ZeroBlockSize = test.zeroBlockSize
+
+			stream, err := io.ReadAll(encoder)
+			if test.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := Inspect(bytes.NewReader(stream), format.RbdDiffv1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, section := range info.Sections {
+				if section.Length > 4096 {
+					t.Errorf("section at offset %d of %d bytes is larger than the maximum section size", section.Offset, section.Length)
+				}
+			}
+		})
+	}
+}
+
+// reportingReader is an in-memory source that reports its own extents
+type reportingReader struct {
+	*bytes.Reader
+	extents ExtentSource
+}
+
+func (r reportingReader) NextExtent(offset int64) (start int64, end int64, err error) {
+	return r.extents.NextExtent(offset)
+}
+
+func TestReaderAtEncoder(t *testing.T) {
+	// the second half of the first extent only contains zeros
+	data := fill(fill(make([]byte, 64*1024), 0, 4096, 1), 32*1024, 4096, 2)
+	extents := []Extent{{0, 8192}, {32 * 1024, 4096}}
+
+	tests := []struct {
+		name     string
+		reader   io.ReaderAt
+		expected []format.Section
+	}{
+		{
+			name:   "scanned for zero blocks",
+			reader: bytes.NewReader(data),
+			expected: []format.Section{
+				{Offset: 0, Length: 4096},
+				{Offset: 32 * 1024, Length: 4096},
+			},
+		},
+		{
+			name:   "extent reporter",
+			reader: reportingReader{Reader: bytes.NewReader(data), extents: NewExtentListSource(int64(len(data)), extents)},
+			// reported extents are sent as they are, including the zeros
+			expected: []format.Section{
+				{Offset: 0, Length: 8192},
+				{Offset: 32 * 1024, Length: 4096},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream, err := io.ReadAll(NewReaderAtEncoder(test.reader, int64(len(data))))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := Inspect(bytes.NewReader(stream), format.RbdDiffv1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Size != int64(len(data)) {
+				t.Errorf("expected size %d, got %d", len(data), info.Size)
+			}
+
+			if !reflect.DeepEqual(info.Sections, test.expected) {
+				t.Errorf("expected sections %+v, got %+v", test.expected, info.Sections)
+			}
+
+			decoded, err := io.ReadAll(NewDecoder(bytes.NewReader(stream)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(decoded, data) {
+				t.Error("decoded stream doesn't match the source")
+			}
+		})
+	}
+}
+
+// encodeFormat encodes data as a stream of f
+func encodeFormat(t *testing.T, data []byte, f format.Format) []byte {
+	t.Helper()
+
+	encoder := NewReaderAtEncoder(bytes.NewReader(data), int64(len(data)))
+	encoder.Format = f
+
+	stream, err := io.ReadAll(encoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stream
+}
+
+func TestDecoderCorruptStream(t *testing.T) {
+	data := sparseTestData(256 * 1024)
+
+	// the first section starts right after the header
+	const (
+		sparsecatHeader = len("sparsecat v1\n") + 1 + 8
+		rbdHeader       = 1 + 8
+	)
+
+	var checksumError *format.ChecksumError
+	var digestError *format.DigestError
+
+	tests := []struct {
+		name   string
+		format format.Format
+		// mask is xor-ed with the byte at offset, a negative offset counts from the end of the stream
+		offset int
+		mask   byte
+		check  func(err error) bool
+	}{
+		{
+			name:   "section offset",
+			format: format.SparsecatV1,
+			offset: sparsecatHeader + 1,
+			mask:   1,
+			check:  func(err error) bool { return errors.As(err, &checksumError) },
+		},
+		{
+			name:   "section offset beyond the file",
+			format: format.SparsecatV1,
+			offset: sparsecatHeader + 1 + 4,
+			mask:   1,
+			check:  func(err error) bool { return err != nil },
+		},
+		{
+			name:   "section offset beyond the file without checksums",
+			format: format.RbdDiffv1,
+			offset: rbdHeader + 1 + 4,
+			mask:   1,
+			check:  func(err error) bool { return err != nil },
+		},
+		{
+			name:   "section length beyond the file without checksums",
+			format: format.RbdDiffv1,
+			offset: rbdHeader + 1 + 8 + 7,
+			mask:   0x40,
+			check:  func(err error) bool { return err != nil },
+		},
+		{
+			name:   "data",
+			format: format.SparsecatV1,
+			offset: sparsecatHeader + 1 + 8 + 8 + 100,
+			mask:   1,
+			check:  func(err error) bool { return errors.As(err, &checksumError) },
+		},
+		{
+			name:   "digest",
+			format: format.SparsecatV1,
+			offset: -1,
+			mask:   1,
+			check:  func(err error) bool { return errors.As(err, &digestError) },
+		},
+		{
+			name:   "truncated",
+			format: format.SparsecatV1,
+			offset: -10,
+			check:  func(err error) bool { return errors.Is(err, io.ErrUnexpectedEOF) },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := encodeFormat(t, data, test.format)
+
+			offset := test.offset
+			if offset < 0 {
+				offset += len(stream)
+			}
+
+			if test.mask == 0 {
+				stream = stream[:offset]
+			} else {
+				stream[offset] ^= test.mask
+			}
+
+			t.Run("WriteTo", func(t *testing.T) {
+				target, err := os.Create(filepath.Join(t.TempDir(), "target"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer target.Close()
+
+				decoder := NewDecoder(bytes.NewReader(stream))
+				decoder.Format = test.format
+
+				_, err = io.Copy(target, decoder)
+				if !test.check(err) {
+					t.Errorf("unexpected error %v", err)
+				}
+
+				info, err := target.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if info.Size() > int64(len(data)) {
+					t.Errorf("the target grew to %d bytes, the file is only %d bytes", info.Size(), len(data))
+				}
+			})
+
+			t.Run("Read", func(t *testing.T) {
+				decoder := NewDecoder(bytes.NewReader(stream))
+				decoder.Format = test.format
+
+				written, err := io.Copy(io.Discard, onlyReader{decoder})
+				if !test.check(err) {
+					t.Errorf("unexpected error %v", err)
+				}
+
+				if written > int64(len(data)) {
+					t.Errorf("%d bytes were decoded, the file is only %d bytes", written, len(data))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package sparsecat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	encryptionHeader = "sparsecat encrypted v1\n"
+
+	encryptionSaltSize   = 16
+	encryptionIterations = 600_000
+
+	// the iteration count of an incoming stream is bounded, so a sender can neither weaken the key nor keep the
+	// receiving side busy deriving it
+	minEncryptionIterations = 100_000
+	maxEncryptionIterations = 10_000_000
+	encryptionChunkSize     = 64 * 1024
+
+	// the final chunk is marked in both the chunk header and the nonce, preventing truncation of the stream
+	finalChunk     = 1
+	finalChunkFlag = 1 << 31
+)
+
+// ErrTruncated is returned when an encrypted stream ends before its final chunk.
+var ErrTruncated = errors.New("encrypted stream has been truncated")
+
+// NewEncryptingReader encrypts the data read from reader, usually an Encoder, using AES-256-GCM. The key is derived
+// from passphrase using PBKDF2 with a random salt, so a passphrase as well as the contents of a key file can be used.
+// The data is split into chunks that are authenticated individually, which allows the receiving side to decrypt the
+// stream while it is coming in.
+//
+//	header: "sparsecat encrypted v1\n" le32(iterations) salt
+//	chunk:  le32(length | final flag) ciphertext
+func NewEncryptingReader(reader io.Reader, passphrase []byte) (io.Reader, error) {
+	salt := make([]byte, encryptionSaltSize)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+
+	aead, err := newStreamCipher(passphrase, salt, encryptionIterations)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptionHeader)+4+encryptionSaltSize)
+	copy(header, encryptionHeader)
+	binary.LittleEndian.PutUint32(header[len(encryptionHeader):], encryptionIterations)
+	copy(header[len(encryptionHeader)+4:], salt)
+
+	return &encryptingReader{
+		reader:    reader,
+		aead:      aead,
+		plaintext: make([]byte, encryptionChunkSize),
+		pending:   bytes.NewReader(header),
+	}, nil
+}
+
+// NewDecryptingReader decrypts a stream created by NewEncryptingReader. The result is usually passed to NewDecoder.
+// An error is returned when the stream has been tampered with or the passphrase is incorrect.
+func NewDecryptingReader(reader io.Reader, passphrase []byte) (io.Reader, error) {
+	header := make([]byte, len(encryptionHeader)+4+encryptionSaltSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %w", err)
+	}
+
+	if string(header[:len(encryptionHeader)]) != encryptionHeader {
+		return nil, fmt.Errorf("invalid header. Expected %q", encryptionHeader)
+	}
+
+	iterations := binary.LittleEndian.Uint32(header[len(encryptionHeader):])
+	if iterations < minEncryptionIterations || iterations > maxEncryptionIterations {
+		return nil, fmt.Errorf("invalid PBKDF2 iteration count %d. Expected between %d and %d", iterations, minEncryptionIterations, maxEncryptionIterations)
+	}
+
+	aead, err := newStreamCipher(passphrase, header[len(encryptionHeader)+4:], int(iterations))
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{reader: reader, aead: aead, pending: bytes.NewReader(nil)}, nil
+}
+
+func newStreamCipher(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, iterations, 32, sha256.New))
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk. Every stream uses a unique key so a counter suffices.
+func chunkNonce(aead cipher.AEAD, counter uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, counter)
+	if final {
+		nonce[len(nonce)-1] = finalChunk
+	}
+	return nonce
+}
+
+type encryptingReader struct {
+	reader    io.Reader
+	aead      cipher.AEAD
+	plaintext []byte
+	counter   uint64
+	pending   *bytes.Reader
+	done      bool
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for e.pending.Len() == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+
+		err := e.sealChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return e.pending.Read(p)
+}
+
+// sealChunk encrypts the next chunk of data. A chunk that isn't completely filled is the final one.
+func (e *encryptingReader) sealChunk() error {
+	read, err := io.ReadFull(e.reader, e.plaintext)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	e.done = read < len(e.plaintext)
+
+	chunk := make([]byte, 4, 4+read+e.aead.Overhead())
+	chunk = e.aead.Seal(chunk, chunkNonce(e.aead, e.counter, e.done), e.plaintext[:read], nil)
+	header := uint32(len(chunk) - 4)
+	if e.done {
+		header |= finalChunkFlag
+	}
+	binary.LittleEndian.PutUint32(chunk, header)
+
+	e.counter++
+	e.pending.Reset(chunk)
+	return nil
+}
+
+type decryptingReader struct {
+	reader  io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	pending *bytes.Reader
+	done    bool
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for d.pending.Len() == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		err := d.openChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return d.pending.Read(p)
+}
+
+func (d *decryptingReader) openChunk() error {
+	var header [4]byte
+	_, err := io.ReadFull(d.reader, header[:])
+	if errors.Is(err, io.EOF) {
+		return ErrTruncated
+	}
+
+	if err != nil {
+		return fmt.Errorf("error reading chunk header: %w", err)
+	}
+
+	length := binary.LittleEndian.Uint32(header[:]) &^ finalChunkFlag
+	final := binary.LittleEndian.Uint32(header[:])&finalChunkFlag != 0
+	if length > encryptionChunkSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("chunk of %d bytes exceeds maximum chunk size", length)
+	}
+
+	ciphertext := make([]byte, length)
+	_, err = io.ReadFull(d.reader, ciphertext)
+	if err != nil {
+		return fmt.Errorf("error reading chunk: %w", err)
+	}
+
+	plaintext, err := d.aead.Open(ciphertext[:0], chunkNonce(d.aead, d.counter, final), ciphertext, nil)
+	if err != nil {
+		return errors.New("error decrypting chunk: message authentication failed")
+	}
+
+	d.done = final
+	d.counter++
+	d.pending.Reset(plaintext)
+	return nil
+}
@@ -0,0 +1,175 @@
+package sparsecat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// encrypt encrypts data using passphrase
+func encrypt(t *testing.T, data []byte, passphrase string) []byte {
+	t.Helper()
+
+	reader, err := NewEncryptingReader(bytes.NewReader(data), []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encrypted
+}
+
+// decrypt decrypts an encrypted stream using passphrase
+func decrypt(encrypted []byte, passphrase string) ([]byte, error) {
+	reader, err := NewDecryptingReader(bytes.NewReader(encrypted), []byte(passphrase))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(reader)
+}
+
+// splitChunks splits an encrypted stream into its header and chunks
+func splitChunks(t *testing.T, encrypted []byte) (header []byte, chunks [][]byte) {
+	t.Helper()
+
+	headerSize := len(encryptionHeader) + 4 + encryptionSaltSize
+	header, encrypted = encrypted[:headerSize], encrypted[headerSize:]
+
+	for len(encrypted) > 0 {
+		length := int(binary.LittleEndian.Uint32(encrypted) &^ finalChunkFlag)
+		if 4+length > len(encrypted) {
+			t.Fatalf("chunk of %d bytes doesn't fit in the stream", length)
+		}
+
+		chunks = append(chunks, encrypted[:4+length])
+		encrypted = encrypted[4+length:]
+	}
+
+	return header, chunks
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 17} {
+		data := make([]byte, size)
+		random.Read(data)
+
+		encrypted := encrypt(t, data, "secret")
+
+		_, chunks := splitChunks(t, encrypted)
+		if len(chunks) != size/encryptionChunkSize+1 {
+			t.Errorf("expected %d chunks for %d bytes, got %d", size/encryptionChunkSize+1, size, len(chunks))
+		}
+
+		decrypted, err := decrypt(encrypted, "secret")
+		if err != nil {
+			t.Fatalf("error decrypting %d bytes: %s", size, err)
+		}
+
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("decrypted data of %d bytes doesn't match", size)
+		}
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	data := make([]byte, 3*encryptionChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	encrypted := encrypt(t, data, "secret")
+	header, chunks := splitChunks(t, encrypted)
+	if len(chunks) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(chunks))
+	}
+
+	join := func(chunks ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, chunks...), nil)
+	}
+
+	flip := func(chunk []byte, offset int, mask byte) []byte {
+		chunk = append([]byte(nil), chunk...)
+		chunk[offset] ^= mask
+		return chunk
+	}
+
+	tests := []struct {
+		name      string
+		stream    []byte
+		truncated bool
+	}{
+		{name: "flipped ciphertext byte", stream: join(chunks[0], flip(chunks[1], 100, 1), chunks[2], chunks[3])},
+		{name: "flipped tag byte", stream: join(chunks[0], chunks[1], chunks[2], flip(chunks[3], len(chunks[3])-1, 1))},
+		{name: "flipped salt", stream: append(flip(header, len(header)-1, 1), encrypted[len(header):]...)},
+		{name: "dropped final chunk", stream: join(chunks[0], chunks[1], chunks[2]), truncated: true},
+		{name: "dropped chunk", stream: join(chunks[0], chunks[2], chunks[3])},
+		{name: "swapped chunks", stream: join(chunks[1], chunks[0], chunks[2], chunks[3])},
+		{name: "repeated chunk", stream: join(chunks[0], chunks[0], chunks[1], chunks[2], chunks[3])},
+		{name: "final chunk marked as not final", stream: join(chunks[0], chunks[1], chunks[2], flip(chunks[3], 3, 0x80))},
+		{name: "chunk marked as final", stream: join(chunks[0], flip(chunks[1], 3, 0x80))},
+		{name: "truncated chunk", stream: join(chunks[0], chunks[1][:100])},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decrypted, err := decrypt(test.stream, "secret")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if test.truncated && !errors.Is(err, ErrTruncated) {
+				t.Errorf("expected ErrTruncated, got %v", err)
+			}
+
+			// only data of authenticated chunks is returned
+			if !bytes.Equal(decrypted, data[:len(decrypted)]) {
+				t.Error("unauthenticated data has been returned")
+			}
+		})
+	}
+}
+
+func TestDecryptionErrors(t *testing.T) {
+	encrypted := encrypt(t, []byte("sparse data"), "secret")
+
+	iterations := func(count uint32) []byte {
+		stream := append([]byte(nil), encrypted...)
+		binary.LittleEndian.PutUint32(stream[len(encryptionHeader):], count)
+		return stream
+	}
+
+	tests := []struct {
+		name       string
+		stream     []byte
+		passphrase string
+	}{
+		{name: "wrong passphrase", stream: encrypted, passphrase: "Secret"},
+		{name: "too few iterations", stream: iterations(minEncryptionIterations - 1), passphrase: "secret"},
+		{name: "too many iterations", stream: iterations(maxEncryptionIterations + 1), passphrase: "secret"},
+		{name: "changed iterations", stream: iterations(encryptionIterations + 1), passphrase: "secret"},
+		{name: "invalid header", stream: append([]byte("sparsecat v1\n"), encrypted[13:]...), passphrase: "secret"},
+		{name: "truncated header", stream: encrypted[:10], passphrase: "secret"},
+		{name: "no chunks", stream: encrypted[:len(encryptionHeader)+4+encryptionSaltSize], passphrase: "secret"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decrypted, err := decrypt(test.stream, test.passphrase)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if len(decrypted) > 0 {
+				t.Errorf("expected no data to be returned, got %d bytes", len(decrypted))
+			}
+		})
+	}
+}
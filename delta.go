@@ -0,0 +1,316 @@
+package sparsecat
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// DefaultDeltaBlockSize is the block size used by SendDelta when the handshake doesn't set one
+	DefaultDeltaBlockSize = 64 * 1024
+
+	// maxDeltaBlockSize guards against allocating huge buffers for a corrupt handshake
+	maxDeltaBlockSize = 64 * 1024 * 1024
+
+	// blockHashLength is the length of a hash on the wire: le64 offset followed by the hash
+	blockHashLength = 8 + sha256.Size
+)
+
+// BlockHash is the SHA-256 hash of a block of a file.
+type BlockHash struct {
+	Offset int64
+	Hash   [sha256.Size]byte
+}
+
+// BlockHashes contains the hashes of the blocks of a file that contain data, sorted by offset. Blocks that are holes
+// or only contain zeros are left out. A block at the end of the file is hashed as if it were padded with zeros.
+type BlockHashes struct {
+	Size      int64
+	BlockSize int64
+	Blocks    []BlockHash
+}
+
+// HashBlocks hashes the blocks of reader that contain data. The holes reported by extents are skipped without
+// reading them.
+func HashBlocks(reader io.ReaderAt, extents ExtentSource, blockSize int64) (*BlockHashes, error) {
+	if blockSize <= 0 || blockSize > maxDeltaBlockSize {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+
+	size, err := extents.Size()
+	if err != nil {
+		return nil, fmt.Errorf("error determining size: %w", err)
+	}
+
+	hashes := &BlockHashes{Size: size, BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+
+	for offset := int64(0); offset < size; {
+		start, end, err := extents.NextExtent(offset)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error detecting data section: %w", err)
+		}
+
+		// hash entire blocks, even when the extent only covers part of them
+		start -= start % blockSize
+		if start < offset {
+			start = offset
+		}
+
+		if end > size {
+			end = size
+		}
+
+		if end <= start {
+			break
+		}
+
+		for ; start < end; start += blockSize {
+			read, err := reader.ReadAt(buf, start)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("error reading block at offset %d: %w", start, err)
+			}
+
+			for index := read; index < len(buf); index++ {
+				buf[index] = 0
+			}
+
+			if isBufferEmpty(buf) {
+				continue
+			}
+
+			hashes.Blocks = append(hashes.Blocks, BlockHash{Offset: start, Hash: sha256.Sum256(buf)})
+		}
+
+		offset = start
+	}
+
+	return hashes, nil
+}
+
+// hashExtents is the ExtentSource of the blocks listed in BlockHashes
+type hashExtents struct {
+	*BlockHashes
+}
+
+func (h hashExtents) Size() (int64, error) {
+	return h.BlockHashes.Size, nil
+}
+
+// NextExtent returns the first run of consecutive blocks containing data at or after offset.
+func (b *BlockHashes) NextExtent(offset int64) (start int64, end int64, err error) {
+	index := b.search(offset)
+	if index == len(b.Blocks) {
+		return 0, 0, io.EOF
+	}
+
+	start = b.Blocks[index].Offset
+	end = start + b.BlockSize
+	for index++; index < len(b.Blocks) && b.Blocks[index].Offset == end; index++ {
+		end += b.BlockSize
+	}
+
+	if end > b.Size {
+		end = b.Size
+	}
+
+	return start, end, nil
+}
+
+// lookup returns the hash of the block starting at offset. False is returned when the block doesn't contain data.
+func (b *BlockHashes) lookup(offset int64) ([sha256.Size]byte, bool) {
+	index := b.search(offset)
+	if index == len(b.Blocks) || b.Blocks[index].Offset != offset {
+		return [sha256.Size]byte{}, false
+	}
+
+	return b.Blocks[index].Hash, true
+}
+
+// search returns the index of the first block ending after offset
+func (b *BlockHashes) search(offset int64) int {
+	return sort.Search(len(b.Blocks), func(index int) bool {
+		return b.Blocks[index].Offset+b.BlockSize > offset
+	})
+}
+
+// hashBlock hashes block as if it were padded with zeros up to blockSize
+func hashBlock(block []byte, blockSize int64) [sha256.Size]byte {
+	hash := sha256.New()
+	hash.Write(block)
+
+	if padding := blockSize - int64(len(block)); padding > 0 {
+		_, _ = io.CopyN(hash, zeroReader{}, padding)
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// writeBlockHashes writes hashes as le64 size, le64 count and the blocks, each as le64 offset followed by the hash
+func writeBlockHashes(writer io.Writer, hashes *BlockHashes) error {
+	var header [8 + 8]byte
+	binary.LittleEndian.PutUint64(header[:8], uint64(hashes.Size))
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(hashes.Blocks)))
+
+	_, err := writer.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	// write the blocks in batches instead of issuing a write for each of them
+	batch := make([]byte, 0, 1024*blockHashLength)
+	for index, block := range hashes.Blocks {
+		var offset [8]byte
+		binary.LittleEndian.PutUint64(offset[:], uint64(block.Offset))
+		batch = append(batch, offset[:]...)
+		batch = append(batch, block.Hash[:]...)
+
+		if len(batch) == cap(batch) || index == len(hashes.Blocks)-1 {
+			_, err = writer.Write(batch)
+			if err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	return nil
+}
+
+// readBlockHashes reads the hashes written by writeBlockHashes. Nothing following them is consumed.
+func readBlockHashes(reader io.Reader, blockSize int64) (*BlockHashes, error) {
+	var header [8 + 8]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := &BlockHashes{Size: int64(binary.LittleEndian.Uint64(header[:8])), BlockSize: blockSize}
+	count := binary.LittleEndian.Uint64(header[8:])
+
+	if hashes.Size < 0 || count > uint64(hashes.Size/blockSize+1) {
+		return nil, fmt.Errorf("invalid hash list of %d blocks for a file of %d bytes", count, hashes.Size)
+	}
+
+	batch := make([]byte, 1024*blockHashLength)
+	for count > 0 {
+		entries := batch
+		if count < uint64(len(batch)/blockHashLength) {
+			entries = batch[:count*blockHashLength]
+		}
+
+		_, err = io.ReadFull(reader, entries)
+		if err != nil {
+			return nil, err
+		}
+
+		for ; len(entries) > 0; entries = entries[blockHashLength:] {
+			block := BlockHash{Offset: int64(binary.LittleEndian.Uint64(entries[:8]))}
+			copy(block.Hash[:], entries[8:blockHashLength])
+
+			if block.Offset < 0 || block.Offset >= hashes.Size || block.Offset%blockSize != 0 {
+				return nil, fmt.Errorf("invalid block offset %d", block.Offset)
+			}
+
+			if len(hashes.Blocks) > 0 && block.Offset <= hashes.Blocks[len(hashes.Blocks)-1].Offset {
+				return nil, fmt.Errorf("block at offset %d is out of order", block.Offset)
+			}
+
+			hashes.Blocks = append(hashes.Blocks, block)
+			count--
+		}
+	}
+
+	return hashes, nil
+}
+
+// SendDelta sends a file to a receiving side that already has an older copy of it. It works over any bidirectional
+// connection, such as a TCP connection or the stdio of ssh. After the handshake the receiving side sends the hashes
+// of the blocks of its copy, which are passed to newStream. The stream it returns, usually a DiffEncoder created by
+// NewDeltaEncoder, only contains the blocks that differ. The handshake of the receiving side is returned.
+// All hashes are kept in memory, see ReceiveDelta. The hashes are sent over conn as they are, encrypting the stream
+// using NewEncryptingReader doesn't hide which blocks changed. Use an encrypted connection, such as TLS, instead.
+func SendDelta(conn io.ReadWriter, handshake Handshake, newStream func(hashes *BlockHashes) io.Reader) (Handshake, error) {
+	if handshake.BlockSize == 0 {
+		handshake.BlockSize = DefaultDeltaBlockSize
+	}
+
+	if handshake.BlockSize < 0 || handshake.BlockSize > maxDeltaBlockSize {
+		return Handshake{}, fmt.Errorf("invalid block size %d", handshake.BlockSize)
+	}
+
+	remote, err := SendHandshake(conn, handshake)
+	if err != nil {
+		return remote, err
+	}
+
+	// the receiving side reports whether it was able to hash its copy
+	err = readStatus(conn)
+	if err != nil {
+		return remote, err
+	}
+
+	hashes, err := readBlockHashes(conn, handshake.BlockSize)
+	if err != nil {
+		return remote, fmt.Errorf("error reading block hashes: %w", err)
+	}
+
+	return remote, SendStream(conn, newStream(hashes))
+}
+
+// ReceiveDelta receives a file sent by SendDelta. target contains the older copy of the file, its blocks are hashed
+// while skipping its holes and the hashes are sent to the sending side. write is called with the handshake of the
+// sending side and the incoming stream, which only contains the blocks that differ. It should apply the stream to
+// target using Decoder.ApplyTo.
+// The hashes of all blocks containing data are kept in memory on both sides, about 40 bytes per block. With the
+// default block size of 64KiB that is roughly 640MB for a 1TB file, a larger block size reduces this.
+func ReceiveDelta(conn io.ReadWriter, handshake Handshake, target *os.File, write func(remote Handshake, stream io.Reader) error) (Handshake, error) {
+	handshake.BlockSize = DefaultDeltaBlockSize
+	remote, err := ReceiveHandshake(conn, handshake)
+	if err != nil {
+		return remote, err
+	}
+
+	hashes, err := hashTarget(target, remote.BlockSize)
+	if err != nil {
+		_ = writeError(conn, err)
+		return remote, err
+	}
+
+	err = writeLines(conn, handshakeOK)
+	if err == nil {
+		err = writeBlockHashes(conn, hashes)
+	}
+
+	if err != nil {
+		return remote, fmt.Errorf("error sending block hashes: %w", err)
+	}
+
+	return remote, receiveStream(conn, remote, write)
+}
+
+// hashTarget hashes the blocks of the target of a delta transfer
+func hashTarget(target *os.File, blockSize int64) (*BlockHashes, error) {
+	extents, err := NewFileExtentSource(target)
+	if err != nil {
+		return nil, fmt.Errorf("error determining extent source: %w", err)
+	}
+
+	hashes, err := HashBlocks(target, extents, blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing target: %w", err)
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,135 @@
+package sparsecat
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sparseFile creates a file of size bytes containing the given blocks of blockSize bytes, leaving the rest a hole
+func sparseFile(t *testing.T, name string, size int64, blockSize int64, blocks map[int64]byte) *os.File {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = file.Close() })
+
+	err = file.Truncate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for block, value := range blocks {
+		length := minInt64(blockSize, size-block*blockSize)
+		_, err = file.WriteAt(bytes.Repeat([]byte{value}, int(length)), block*blockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return file
+}
+
+func TestDeltaTransfer(t *testing.T) {
+	const blockSize = 4096
+
+	tests := []struct {
+		name         string
+		sourceSize   int64
+		sourceBlocks map[int64]byte
+		targetSize   int64
+		targetBlocks map[int64]byte
+		// expectedData is the amount of data the stream is expected to contain
+		expectedData int64
+	}{
+		{
+			name:         "changed, zeroed and unchanged blocks",
+			sourceSize:   16 * blockSize,
+			sourceBlocks: map[int64]byte{0: 1, 1: 2, 3: 4, 8: 5},
+			targetSize:   16 * blockSize,
+			// block 0 is unchanged, 1 changed, 2 zeroed, 3 and 8 are new and 10 zeroed
+			targetBlocks: map[int64]byte{0: 1, 1: 9, 2: 3, 10: 6},
+			expectedData: 3 * blockSize,
+		},
+		{
+			name:         "larger target",
+			sourceSize:   8 * blockSize,
+			sourceBlocks: map[int64]byte{0: 1, 5: 2},
+			targetSize:   20 * blockSize,
+			targetBlocks: map[int64]byte{0: 1, 5: 3, 12: 4, 19: 5},
+			expectedData: blockSize,
+		},
+		{
+			name:         "smaller target",
+			sourceSize:   20*blockSize + 100,
+			sourceBlocks: map[int64]byte{0: 1, 5: 2, 12: 3, 20: 4},
+			targetSize:   8 * blockSize,
+			targetBlocks: map[int64]byte{0: 1, 5: 2, 7: 3},
+			expectedData: blockSize + 100,
+		},
+		{
+			name:         "empty target",
+			sourceSize:   4*blockSize + 10,
+			sourceBlocks: map[int64]byte{1: 1, 4: 2},
+			targetSize:   0,
+			expectedData: blockSize + 10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := sparseFile(t, "source", test.sourceSize, blockSize, test.sourceBlocks)
+			target := sparseFile(t, "target", test.targetSize, blockSize, test.targetBlocks)
+
+			sendConn, receiveConn := net.Pipe()
+			defer sendConn.Close()
+			defer receiveConn.Close()
+
+			var written int64
+			done := make(chan error, 1)
+			go func() {
+				_, err := ReceiveDelta(receiveConn, Handshake{}, target, func(remote Handshake, stream io.Reader) error {
+					var err error
+					written, err = NewDecoder(stream).ApplyTo(target)
+					return err
+				})
+				done <- err
+			}()
+
+			_, err := SendDelta(sendConn, Handshake{BlockSize: blockSize}, func(hashes *BlockHashes) io.Reader {
+				return NewDeltaEncoder(source, hashes)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = <-done
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := os.ReadFile(source.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := os.ReadFile(target.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(actual, expected) {
+				t.Error("target doesn't match the source after the transfer")
+			}
+
+			if written != test.expectedData {
+				t.Errorf("expected %d bytes of changed data to be sent, got %d", test.expectedData, written)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package sparsecat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// NewDiffEncoder creates a DiffEncoder describing the changes from oldFile to newFile.
+func NewDiffEncoder(oldFile, newFile *os.File) *DiffEncoder {
+	return &DiffEncoder{oldFile: oldFile, newFile: newFile, oldReader: oldFile, newReader: newFile, Format: format.RbdDiffv1, MaxSectionSize: 1 << 32, BlockSize: 4096}
+}
+
+// NewExtentDiffEncoder creates a DiffEncoder for sources that aren't an *os.File. The extents of both sources are
+// used to skip the parts that are holes in both of them.
+func NewExtentDiffEncoder(oldReader io.ReaderAt, oldExtents ExtentSource, newReader io.ReaderAt, newExtents ExtentSource) *DiffEncoder {
+	return &DiffEncoder{oldReader: oldReader, oldExtents: oldExtents, newReader: newReader, newExtents: newExtents, Format: format.RbdDiffv1, MaxSectionSize: 1 << 32, BlockSize: 4096}
+}
+
+// NewDeltaEncoder creates a DiffEncoder describing the changes from the file hashes were created of to newFile, for
+// example the copy of the file on the receiving side of SendDelta. Blocks are compared using their hashes, so the
+// block size of hashes is used.
+func NewDeltaEncoder(newFile *os.File, hashes *BlockHashes) *DiffEncoder {
+	return &DiffEncoder{oldHashes: hashes, oldExtents: hashExtents{hashes}, newFile: newFile, newReader: newFile, Format: format.RbdDiffv1, MaxSectionSize: 1 << 32, BlockSize: hashes.BlockSize}
+}
+
+// DiffEncoder encodes the changes between two versions of a file to a stream, like rbd export-diff does for the
+// snapshots of an image. Blocks that changed are sent as data sections and blocks that changed to zeros as zero
+// sections. The holes of the stream are the parts of the file that didn't change, so the stream has to be applied
+// to a copy of the old file using Decoder.ApplyTo. Parts that are holes in both files are skipped without reading
+// them. The size of the stream is the size of the new file.
+type DiffEncoder struct {
+	oldFile    *os.File
+	newFile    *os.File
+	oldReader  io.ReaderAt
+	newReader  io.ReaderAt
+	oldExtents ExtentSource
+	newExtents ExtentSource
+	stream     format.Format
+
+	// oldHashes replaces the old file when only the hashes of its blocks are known
+	oldHashes *BlockHashes
+
+	Format         format.Format
+	MaxSectionSize int64
+
+	// BlockSize is the granularity in bytes at which the files are compared.
+	BlockSize int64
+	// FromSnapshot and ToSnapshot name the old and new file in the header of the stream, when the format supports
+	// snapshot names.
+	FromSnapshot string
+	ToSnapshot   string
+
+	oldSize        int64
+	newSize        int64
+	maxSectionSize int64
+
+	oldBuffer    []byte
+	newBuffer    []byte
+	bufferOffset int64
+
+	// offset is the position up to which the files have been compared, regionEnd the end of the part of the files
+	// that may contain data
+	offset    int64
+	regionEnd int64
+	pending   []format.Section
+
+	currentSection       io.Reader
+	currentSectionLength int64
+	currentSectionRead   int
+
+	done bool
+}
+
+func (e *DiffEncoder) Read(p []byte) (int, error) {
+	if e.currentSection == nil {
+		err := e.start()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	read, err := e.currentSection.Read(p)
+	e.currentSectionRead += read
+
+	if err == nil {
+		return read, err
+	}
+
+	if !errors.Is(err, io.EOF) {
+		return read, err
+	}
+
+	// current section has ended. Was it expected?
+	if e.currentSectionLength != int64(e.currentSectionRead) {
+		return read, fmt.Errorf("read size doesn't equal section size. %d vs %d. %w", e.currentSectionRead, e.currentSectionLength, io.ErrUnexpectedEOF)
+	}
+
+	// are there more sections to come?
+	if e.done {
+		return read, io.EOF
+	}
+
+	e.currentSectionRead = 0
+
+	err = e.nextSection()
+	return read, err
+}
+
+// start inspects both files and makes the header the current section of the stream
+func (e *DiffEncoder) start() error {
+	if e.BlockSize <= 0 {
+		return fmt.Errorf("invalid block size %d", e.BlockSize)
+	}
+
+	if e.oldHashes != nil && e.BlockSize != e.oldHashes.BlockSize {
+		return fmt.Errorf("block size %d doesn't match the block size %d of the hashes", e.BlockSize, e.oldHashes.BlockSize)
+	}
+
+	var err error
+	e.oldExtents, e.oldSize, err = inspectDiffSource(e.oldFile, e.oldExtents)
+	if err != nil {
+		return fmt.Errorf("error inspecting old file: %w", err)
+	}
+
+	e.newExtents, e.newSize, err = inspectDiffSource(e.newFile, e.newExtents)
+	if err != nil {
+		return fmt.Errorf("error inspecting new file: %w", err)
+	}
+
+	e.stream = format.ForStream(e.Format)
+
+	// the format may not be able to handle sections as large as requested
+	e.maxSectionSize = e.MaxSectionSize
+	if limiter, ok := e.stream.(format.SectionSizeLimiter); ok {
+		limit := limiter.MaxSectionSize()
+		if limit > 0 && limit < e.maxSectionSize {
+			e.maxSectionSize = limit
+		}
+	}
+
+	size := int64(BLK_READ_BUFFER)
+	if size > e.maxSectionSize {
+		size = e.maxSectionSize
+	}
+
+	size -= size % e.BlockSize
+	if size < e.BlockSize {
+		size = e.BlockSize
+	}
+
+	e.oldBuffer = make([]byte, size)
+	e.newBuffer = make([]byte, size)
+
+	e.currentSection, e.currentSectionLength = format.GetHeaderReader(e.stream, format.Header{
+		Size:         e.newSize,
+		FromSnapshot: e.FromSnapshot,
+		ToSnapshot:   e.ToSnapshot,
+	})
+
+	return nil
+}
+
+// inspectDiffSource determines the extent source of file when none was given, and the size of the source
+func inspectDiffSource(file *os.File, extents ExtentSource) (ExtentSource, int64, error) {
+	if extents == nil {
+		var err error
+		extents, err = NewFileExtentSource(file)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error determining extent source: %w", err)
+		}
+	}
+
+	size, err := extents.Size()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error determining size: %w", err)
+	}
+
+	return extents, size, nil
+}
+
+// nextSection makes the next changed section the current section of the stream
+func (e *DiffEncoder) nextSection() error {
+	for len(e.pending) == 0 {
+		if e.offset >= e.newSize {
+			e.currentSection, e.currentSectionLength = e.stream.GetEndTagReader()
+			e.done = true
+			return nil
+		}
+
+		err := e.compare()
+		if err != nil {
+			return err
+		}
+	}
+
+	section := e.pending[0]
+	e.pending = e.pending[1:]
+
+	if section.Zero {
+		e.currentSection, e.currentSectionLength = e.stream.GetSectionReader(nil, section)
+		return nil
+	}
+
+	start := section.Offset - e.bufferOffset
+	data := e.newBuffer[start : start+section.Length]
+	e.currentSection, e.currentSectionLength = e.stream.GetSectionReader(bytes.NewReader(data), section)
+
+	return nil
+}
+
+// compare reads the next part of both files and queues the sections that changed
+func (e *DiffEncoder) compare() error {
+	if e.offset >= e.regionEnd {
+		start, end, err := e.nextRegion()
+		if errors.Is(err, io.EOF) {
+			e.offset = e.newSize
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		e.offset, e.regionEnd = start, end
+	}
+
+	length := minInt64(int64(len(e.newBuffer)), e.regionEnd-e.offset)
+	newData := e.newBuffer[:length]
+	oldData := e.oldBuffer[:length]
+
+	read, err := e.newReader.ReadAt(newData, e.offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading new file at offset %d: %w", e.offset, err)
+	}
+
+	if int64(read) != length {
+		return fmt.Errorf("error reading new file at offset %d: %w", e.offset, io.ErrUnexpectedEOF)
+	}
+
+	// the part of the old file beyond its end reads as zeros
+	read = 0
+	if e.oldHashes == nil && e.offset < e.oldSize {
+		read, err = e.oldReader.ReadAt(oldData[:minInt64(length, e.oldSize-e.offset)], e.offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading old file at offset %d: %w", e.offset, err)
+		}
+	}
+
+	for index := read; index < len(oldData); index++ {
+		oldData[index] = 0
+	}
+
+	e.bufferOffset = e.offset
+	for block := int64(0); block < length; block += e.BlockSize {
+		blockEnd := minInt64(block+e.BlockSize, length)
+		newBlock := newData[block:blockEnd]
+		zero := isBufferEmpty(newBlock)
+
+		if !e.changed(e.offset+block, newBlock, oldData[block:blockEnd], zero) {
+			continue
+		}
+
+		e.queue(format.Section{
+			Offset: e.offset + block,
+			Length: blockEnd - block,
+			Zero:   zero,
+		})
+	}
+
+	e.offset += length
+	return nil
+}
+
+// changed reports whether the block of the new file at offset differs from the old file. oldBlock is only used when
+// the old file itself is available.
+func (e *DiffEncoder) changed(offset int64, newBlock []byte, oldBlock []byte, zero bool) bool {
+	if e.oldHashes == nil {
+		return !bytes.Equal(newBlock, oldBlock)
+	}
+
+	// blocks without a hash only contain zeros
+	hash, exists := e.oldHashes.lookup(offset)
+	if !exists {
+		return !zero
+	}
+
+	return zero || hashBlock(newBlock, e.BlockSize) != hash
+}
+
+// queue adds a changed block to the pending sections, merging it with the previous one when possible
+func (e *DiffEncoder) queue(block format.Section) {
+	if len(e.pending) > 0 {
+		last := &e.pending[len(e.pending)-1]
+		if last.Zero == block.Zero && last.Offset+last.Length == block.Offset && last.Length+block.Length <= e.maxSectionSize {
+			last.Length += block.Length
+			return
+		}
+	}
+
+	e.pending = append(e.pending, block)
+}
+
+// nextRegion returns the next part of the files, starting at the current offset, that contains data in at least one
+// of them. io.EOF is returned when both files only contain holes after the current offset.
+func (e *DiffEncoder) nextRegion() (start, end int64, err error) {
+	newStart, newEnd, err := nextExtentBefore(e.newExtents, e.offset, e.newSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error detecting data section of new file: %w", err)
+	}
+
+	oldStart, oldEnd, err := nextExtentBefore(e.oldExtents, e.offset, minInt64(e.oldSize, e.newSize))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error detecting data section of old file: %w", err)
+	}
+
+	if newStart >= newEnd && oldStart >= oldEnd {
+		return 0, 0, io.EOF
+	}
+
+	start, end = newStart, newEnd
+	if newStart >= newEnd || (oldStart < oldEnd && oldStart < newStart) {
+		start, end = oldStart, oldEnd
+	} else if oldStart < oldEnd && oldStart == newStart && oldEnd < newEnd {
+		end = oldEnd
+	}
+
+	// compare entire blocks, so they line up with the hashes of a delta transfer
+	start -= start % e.BlockSize
+	if start < e.offset {
+		start = e.offset
+	}
+
+	if remainder := end % e.BlockSize; remainder != 0 {
+		end += e.BlockSize - remainder
+	}
+
+	if end > e.newSize {
+		end = e.newSize
+	}
+
+	return start, end, nil
+}
+
+// nextExtentBefore returns the first extent of extents at or after offset, clamped to limit. An empty extent is
+// returned when there is no data between offset and limit.
+func nextExtentBefore(extents ExtentSource, offset int64, limit int64) (start, end int64, err error) {
+	if offset >= limit {
+		return limit, limit, nil
+	}
+
+	start, end, err = extents.NextExtent(offset)
+	if errors.Is(err, io.EOF) {
+		return limit, limit, nil
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start < offset {
+		start = offset
+	}
+
+	if end > limit {
+		end = limit
+	}
+
+	if start >= end {
+		return limit, limit, nil
+	}
+
+	return start, end, nil
+}
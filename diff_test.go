@@ -0,0 +1,158 @@
+package sparsecat
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// diffSource is an in-memory version of a file used by the DiffEncoder tests
+type diffSource struct {
+	data    []byte
+	extents []Extent
+}
+
+// fill returns a copy of data with length bytes at offset set to value
+func fill(data []byte, offset, length int, value byte) []byte {
+	data = append([]byte(nil), data...)
+	copy(data[offset:offset+length], bytes.Repeat([]byte{value}, length))
+	return data
+}
+
+// applyDiff applies stream to a file containing old and returns the result
+func applyDiff(t *testing.T, old []byte, stream []byte) []byte {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "image")
+	err := os.WriteFile(name, old, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	_, err = NewDecoder(bytes.NewReader(stream)).ApplyTo(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestDiffEncoder(t *testing.T) {
+	const kib = 1024
+
+	tests := []struct {
+		name     string
+		old      diffSource
+		new      diffSource
+		expected []format.Section
+	}{
+		{
+			name:     "identical",
+			old:      diffSource{data: fill(make([]byte, 16*kib), 4*kib, 4*kib, 1), extents: []Extent{{4 * kib, 4 * kib}}},
+			new:      diffSource{data: fill(make([]byte, 16*kib), 4*kib, 4*kib, 1), extents: []Extent{{4 * kib, 4 * kib}}},
+			expected: []format.Section{},
+		},
+		{
+			name: "overlapping extents",
+			old:  diffSource{data: fill(make([]byte, 32*kib), 0, 16*kib, 1), extents: []Extent{{0, 16 * kib}}},
+			new: diffSource{
+				data:    fill(fill(fill(make([]byte, 32*kib), 8*kib, 4*kib, 1), 12*kib, 4*kib, 2), 16*kib, 8*kib, 3),
+				extents: []Extent{{8 * kib, 16 * kib}},
+			},
+			// the files are compared an extent at the time, so sections aren't merged across extents
+			expected: []format.Section{
+				{Offset: 0, Length: 8 * kib, Zero: true},
+				{Offset: 12 * kib, Length: 4 * kib},
+				{Offset: 16 * kib, Length: 8 * kib},
+			},
+		},
+		{
+			name: "extents not aligned to blocks",
+			old:  diffSource{data: fill(make([]byte, 16*kib), 5*kib, 1*kib, 1), extents: []Extent{{5 * kib, 1 * kib}}},
+			new:  diffSource{data: fill(make([]byte, 16*kib), 6*kib, 3*kib, 2), extents: []Extent{{6 * kib, 3 * kib}}},
+			expected: []format.Section{
+				{Offset: 4 * kib, Length: 4 * kib},
+				{Offset: 8 * kib, Length: 4 * kib},
+			},
+		},
+		{
+			name: "shrunken new file",
+			old:  diffSource{data: fill(make([]byte, 32*kib), 0, 32*kib, 1), extents: []Extent{{0, 32 * kib}}},
+			new:  diffSource{data: fill(fill(make([]byte, 10*kib), 0, 10*kib, 1), 4*kib, 4*kib, 2), extents: []Extent{{0, 10 * kib}}},
+			expected: []format.Section{
+				{Offset: 4 * kib, Length: 4 * kib},
+			},
+		},
+		{
+			name: "grown new file",
+			old:  diffSource{data: fill(make([]byte, 8*kib), 0, 8*kib, 1), extents: []Extent{{0, 8 * kib}}},
+			new:  diffSource{data: fill(fill(make([]byte, 16*kib), 0, 8*kib, 1), 12*kib, 4*kib, 2), extents: []Extent{{0, 16 * kib}}},
+			expected: []format.Section{
+				{Offset: 12 * kib, Length: 4 * kib},
+			},
+		},
+		{
+			name: "partial last block",
+			old:  diffSource{data: fill(make([]byte, 6000), 0, 6000, 1), extents: []Extent{{0, 6000}}},
+			new:  diffSource{data: fill(fill(make([]byte, 6000), 0, 6000, 1), 5000, 1, 2), extents: []Extent{{0, 6000}}},
+			expected: []format.Section{
+				{Offset: 4 * kib, Length: 6000 - 4*kib},
+			},
+		},
+		{
+			name: "partial last block zeroed",
+			old:  diffSource{data: fill(make([]byte, 6000), 0, 6000, 1), extents: []Extent{{0, 6000}}},
+			new:  diffSource{data: fill(make([]byte, 6000), 0, 4*kib, 1), extents: []Extent{{0, 4 * kib}}},
+			expected: []format.Section{
+				{Offset: 4 * kib, Length: 6000 - 4*kib, Zero: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := NewExtentDiffEncoder(
+				bytes.NewReader(test.old.data), NewExtentListSource(int64(len(test.old.data)), test.old.extents),
+				bytes.NewReader(test.new.data), NewExtentListSource(int64(len(test.new.data)), test.new.extents),
+			)
+
+			stream, err := io.ReadAll(encoder)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := Inspect(bytes.NewReader(stream), format.RbdDiffv1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Size != int64(len(test.new.data)) {
+				t.Errorf("expected size %d, got %d", len(test.new.data), info.Size)
+			}
+
+			if !reflect.DeepEqual(info.Sections, test.expected) {
+				t.Errorf("expected sections %+v, got %+v", test.expected, info.Sections)
+			}
+
+			if !bytes.Equal(applyDiff(t, test.old.data, stream), test.new.data) {
+				t.Error("applying the diff to the old file doesn't result in the new file")
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	sparsehttp "github.com/svenwiltink/sparsecat/http"
+)
+
+func main() {
+	if len(os.Args) != 3 || (os.Args[1] != "upload" && os.Args[1] != "download") {
+		log.Fatalln(os.Args[0], "upload|download <file>")
+	}
+
+	client := sparsehttp.NewClient()
+	url := "http://localhost:6969/images/" + os.Args[2]
+
+	if os.Args[1] == "upload" {
+		source, err := os.Open(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer source.Close()
+
+		err = client.Upload(url, source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	target, err := os.Create(os.Args[2])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer target.Close()
+
+	err = client.Download(url, target)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/svenwiltink/sparsecat"
+	sparsehttp "github.com/svenwiltink/sparsecat/http"
+)
+
+func main() {
+	handler := sparsehttp.NewHandler(".")
+	handler.ErrorLog = func(err error) {
+		log.Println(err)
+	}
+
+	http.Handle("/images/", http.StripPrefix("/images/", handler))
+
+	// the Decoder can write to any io.Writer, such as a gzip writer storing a compressed copy of the image
+	http.HandleFunc("/store-zipped", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			http.NotFound(writer, request)
+			return
+		}
+
+		decoder := sparsecat.NewDecoder(request.Body)
+		decoder.MaxFileSize = sparsehttp.DefaultMaxFileSize
+
+		target, err := os.Create("based.raw.gz")
+		if err != nil {
+			log.Println(err)
+			http.Error(writer, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer target.Close()
+
+		zw := gzip.NewWriter(target)
+		_, err = io.Copy(zw, decoder)
+		if err == nil {
+			err = zw.Close()
+		}
+
+		if err != nil {
+			log.Println(err)
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writer.WriteHeader(http.StatusCreated)
+	})
+
+	log.Fatal(http.ListenAndServe("localhost:6969", nil))
+}
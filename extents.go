@@ -0,0 +1,181 @@
+package sparsecat
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// ExtentSource reports which parts of a source contain data. The Encoder uses it to skip the holes in a source.
+// Besides the built-in sources, implementations can be based on external metadata such as LVM thin pool
+// metadata dumps or the output of qemu-img map.
+type ExtentSource interface {
+	ExtentReporter
+	// Size returns the total size of the source in bytes.
+	Size() (int64, error)
+}
+
+// ExtentReporter can be implemented by an io.ReaderAt passed to NewReaderAtEncoder when it knows which parts of
+// it contain data.
+type ExtentReporter interface {
+	// NextExtent returns the start and end of the first extent containing data at or after offset. io.EOF must be
+	// returned when there is no data left after offset.
+	NextExtent(offset int64) (start int64, end int64, err error)
+}
+
+// Extent is a range of a source that contains data.
+type Extent struct {
+	Offset, Length int64
+}
+
+// NewFileExtentSource returns the ExtentSource best suited for file. Filesystem hole detection is used when
+// available. Block devices and files on filesystems without hole detection are scanned for zero blocks instead.
+func NewFileExtentSource(file *os.File) (ExtentSource, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error running stat: %w", err)
+	}
+
+	if IsBlockDevice(info) {
+		return NewBlockDeviceSource(file)
+	}
+
+	if !supportsSeekHole(file) {
+		return NewZeroScanSource(info.Size()), nil
+	}
+
+	return nativeExtentSource(file), nil
+}
+
+// fileExtentSource uses the platform specific detectDataSection to find the data in a file.
+type fileExtentSource struct {
+	file *os.File
+}
+
+func (f fileExtentSource) NextExtent(offset int64) (start int64, end int64, err error) {
+	return detectDataSection(f.file, offset)
+}
+
+func (f fileExtentSource) Size() (int64, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// NewBlockDeviceSource returns an ExtentSource for a block device. Block devices don't support hole detection
+// so the Encoder scans the device for zero blocks. Blocks of BLK_READ_BUFFER bytes are skipped when they only
+// contain zeros, unless Encoder.DetectZeroBlocks has been set to scan at the granularity of Encoder.ZeroBlockSize.
+func NewBlockDeviceSource(file *os.File) (ExtentSource, error) {
+	size, err := getBlockDeviceSize(file)
+	if err != nil {
+		return nil, fmt.Errorf("error determining size of block device: %w", err)
+	}
+
+	return zeroScanSource{size: int64(size), blockSize: BLK_READ_BUFFER}, nil
+}
+
+// NewZeroScanSource returns an ExtentSource for a source of size bytes that can't detect its own holes. The
+// entire source is reported as data and an Encoder using it scans the data for blocks that only contain zeros,
+// as if Encoder.DetectZeroBlocks has been set.
+func NewZeroScanSource(size int64) ExtentSource {
+	return zeroScanSource{size: size}
+}
+
+type zeroScanSource struct {
+	size int64
+	// blockSize is the granularity of the scan, 0 uses Encoder.ZeroBlockSize
+	blockSize int64
+}
+
+func (z zeroScanSource) NextExtent(offset int64) (start int64, end int64, err error) {
+	if offset >= z.size {
+		return 0, 0, io.EOF
+	}
+
+	return offset, z.size, nil
+}
+
+func (z zeroScanSource) Size() (int64, error) {
+	return z.size, nil
+}
+
+// NewExtentListSource returns an ExtentSource for a source of size bytes of which the extents containing data are
+// known ahead of time. The extents don't have to be sorted. Overlapping and adjacent extents are merged and extents
+// are limited to the size of the source.
+func NewExtentListSource(size int64, extents []Extent) ExtentSource {
+	sorted := make([]Extent, 0, len(extents))
+	for _, extent := range extents {
+		start, end := maxInt64(extent.Offset, 0), minInt64(extent.Offset+extent.Length, size)
+		if start < end {
+			sorted = append(sorted, Extent{Offset: start, Length: end - start})
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+
+	list := extentList{size: size}
+	for _, extent := range sorted {
+		if len(list.extents) > 0 {
+			previous := &list.extents[len(list.extents)-1]
+			if extent.Offset <= previous.Offset+previous.Length {
+				previous.Length = maxInt64(previous.Length, extent.Offset+extent.Length-previous.Offset)
+				continue
+			}
+		}
+
+		list.extents = append(list.extents, extent)
+	}
+
+	return list
+}
+
+type extentList struct {
+	size    int64
+	extents []Extent
+}
+
+func (l extentList) NextExtent(offset int64) (start int64, end int64, err error) {
+	index := sort.Search(len(l.extents), func(i int) bool {
+		return l.extents[i].Offset+l.extents[i].Length > offset
+	})
+
+	if index == len(l.extents) {
+		return 0, 0, io.EOF
+	}
+
+	start = l.extents[index].Offset
+	if start < offset {
+		start = offset
+	}
+
+	if start >= l.size {
+		return 0, 0, io.EOF
+	}
+
+	end = l.extents[index].Offset + l.extents[index].Length
+	if end > l.size {
+		end = l.size
+	}
+
+	return start, end, nil
+}
+
+func (l extentList) Size() (int64, error) {
+	return l.size, nil
+}
+
+// reportedExtents turns an ExtentReporter with a known size into an ExtentSource.
+type reportedExtents struct {
+	ExtentReporter
+	size int64
+}
+
+func (r reportedExtents) Size() (int64, error) {
+	return r.size, nil
+}
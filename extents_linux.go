@@ -0,0 +1,8 @@
+package sparsecat
+
+import "os"
+
+// nativeExtentSource returns the preferred ExtentSource for files on filesystems capable of detecting holes.
+func nativeExtentSource(file *os.File) ExtentSource {
+	return NewFiemapSource(file)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package sparsecat
+
+import "os"
+
+// nativeExtentSource returns the preferred ExtentSource for files on filesystems capable of detecting holes.
+func nativeExtentSource(file *os.File) ExtentSource {
+	return fileExtentSource{file: file}
+}
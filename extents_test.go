@@ -0,0 +1,155 @@
+package sparsecat
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// collectExtents returns all extents reported by source
+func collectExtents(t *testing.T, source ExtentReporter) []Extent {
+	t.Helper()
+
+	extents := []Extent{}
+	var offset int64
+	for {
+		start, end, err := source.NextExtent(offset)
+		if errors.Is(err, io.EOF) {
+			return extents
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if start < offset || end <= start {
+			t.Fatalf("invalid extent %d-%d reported for offset %d", start, end, offset)
+		}
+
+		extents = append(extents, Extent{Offset: start, Length: end - start})
+		offset = end
+	}
+}
+
+// coversExtent reports whether one of extents contains all of extent
+func coversExtent(extents []Extent, extent Extent) bool {
+	for _, candidate := range extents {
+		if candidate.Offset <= extent.Offset && candidate.Offset+candidate.Length >= extent.Offset+extent.Length {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestExtentListSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		extents  []Extent
+		expected []Extent
+	}{
+		{
+			name:     "no extents",
+			size:     100,
+			expected: []Extent{},
+		},
+		{
+			name:     "unsorted",
+			size:     100,
+			extents:  []Extent{{60, 10}, {0, 10}, {30, 10}},
+			expected: []Extent{{0, 10}, {30, 10}, {60, 10}},
+		},
+		{
+			name:     "overlapping",
+			size:     100,
+			extents:  []Extent{{10, 20}, {20, 5}, {25, 10}, {50, 10}, {40, 10}},
+			expected: []Extent{{10, 25}, {40, 20}},
+		},
+		{
+			name:     "empty extents",
+			size:     100,
+			extents:  []Extent{{10, 0}, {20, -5}, {30, 10}},
+			expected: []Extent{{30, 10}},
+		},
+		{
+			name:     "out of range",
+			size:     100,
+			extents:  []Extent{{-10, 20}, {90, 20}, {100, 10}, {200, 10}},
+			expected: []Extent{{0, 10}, {90, 10}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := NewExtentListSource(test.size, test.extents)
+
+			size, err := source.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size != test.size {
+				t.Errorf("expected size %d, got %d", test.size, size)
+			}
+
+			extents := collectExtents(t, source)
+			if !reflect.DeepEqual(extents, test.expected) {
+				t.Errorf("expected extents %v, got %v", test.expected, extents)
+			}
+		})
+	}
+}
+
+func TestExtentListSourceOffset(t *testing.T) {
+	source := NewExtentListSource(100, []Extent{{10, 20}, {50, 10}})
+
+	tests := []struct {
+		offset     int64
+		start, end int64
+		eof        bool
+	}{
+		{offset: 0, start: 10, end: 30},
+		{offset: 15, start: 15, end: 30},
+		{offset: 30, start: 50, end: 60},
+		{offset: 59, start: 59, end: 60},
+		{offset: 60, eof: true},
+	}
+
+	for _, test := range tests {
+		start, end, err := source.NextExtent(test.offset)
+		if test.eof {
+			if !errors.Is(err, io.EOF) {
+				t.Errorf("expected io.EOF at offset %d, got %d-%d %v", test.offset, start, end, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if start != test.start || end != test.end {
+			t.Errorf("expected %d-%d at offset %d, got %d-%d", test.start, test.end, test.offset, start, end)
+		}
+	}
+}
+
+func TestZeroScanSource(t *testing.T) {
+	source := NewZeroScanSource(100)
+
+	extents := collectExtents(t, source)
+	if !reflect.DeepEqual(extents, []Extent{{0, 100}}) {
+		t.Errorf("expected the entire source to be reported, got %v", extents)
+	}
+
+	start, end, err := source.NextExtent(40)
+	if err != nil || start != 40 || end != 100 {
+		t.Errorf("expected 40-100 at offset 40, got %d-%d %v", start, end, err)
+	}
+
+	if len(collectExtents(t, NewZeroScanSource(0))) != 0 {
+		t.Error("expected no extents for an empty source")
+	}
+}
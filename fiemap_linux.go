@@ -0,0 +1,218 @@
+package sparsecat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// FS_IOC_FIEMAP is _IOWR('f', 11, struct fiemap)
+	fsIocFiemap = 0xC020660B
+
+	fiemapFlagSync        = 0x1
+	fiemapExtentLast      = 0x1
+	fiemapExtentUnwritten = 0x800
+
+	// amount of extents fetched per ioctl
+	fiemapBatchSize = 256
+)
+
+// struct fiemap from linux/fiemap.h without the trailing extents
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+}
+
+// struct fiemap_extent from linux/fiemap.h
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+// NewFiemapSource returns an ExtentSource that uses the FIEMAP ioctl to find the data in file. Extents are fetched
+// in batches and unwritten extents, such as those created by fallocate, are reported as holes. When the filesystem
+// doesn't support FIEMAP SEEK_DATA and SEEK_HOLE are used instead.
+func NewFiemapSource(file *os.File) ExtentSource {
+	return &fiemapSource{file: file}
+}
+
+type fiemapSource struct {
+	file *os.File
+	size int64
+
+	// extents contains the merged data extents of the last batch. It covers the range between
+	// batchStart and batchEnd, or everything after batchStart when last has been set.
+	extents    []Extent
+	batchStart int64
+	batchEnd   int64
+	last       bool
+	fetched    bool
+
+	unsupported bool
+}
+
+func (f *fiemapSource) NextExtent(offset int64) (start int64, end int64, err error) {
+	if f.unsupported {
+		return detectDataSection(f.file, offset)
+	}
+
+	for {
+		if !f.covers(offset) {
+			err = f.fetch(offset)
+			if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) {
+				f.unsupported = true
+				return detectDataSection(f.file, offset)
+			}
+
+			if err != nil {
+				return 0, 0, fmt.Errorf("error fetching extents: %w", err)
+			}
+		}
+
+		start, end, found := f.find(offset)
+		if found {
+			return start, end, nil
+		}
+
+		if f.last {
+			return 0, 0, io.EOF
+		}
+
+		offset = f.batchEnd
+	}
+}
+
+func (f *fiemapSource) Size() (int64, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// covers reports whether the extents of the last batch describe offset
+func (f *fiemapSource) covers(offset int64) bool {
+	if !f.fetched || offset < f.batchStart {
+		return false
+	}
+
+	return f.last || offset < f.batchEnd
+}
+
+// find returns the first extent of the last batch containing data at or after offset. Extents are limited
+// to the size of the file as some filesystems allocate blocks past the end of a file.
+func (f *fiemapSource) find(offset int64) (start int64, end int64, found bool) {
+	index := sort.Search(len(f.extents), func(i int) bool {
+		return f.extents[i].Offset+f.extents[i].Length > offset
+	})
+
+	if index == len(f.extents) {
+		return 0, 0, false
+	}
+
+	start = f.extents[index].Offset
+	if start < offset {
+		start = offset
+	}
+
+	end = f.extents[index].Offset + f.extents[index].Length
+	if end > f.size {
+		end = f.size
+	}
+
+	if start >= end {
+		return 0, 0, false
+	}
+
+	return start, end, true
+}
+
+// fetch retrieves a batch of extents starting at offset. The file is synced on the first call so extents that
+// are still being written are reported as well.
+func (f *fiemapSource) fetch(offset int64) error {
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+
+	// both structs consist of 64 bit fields, so a []uint64 keeps them aligned
+	const headerWords = unsafe.Sizeof(fiemap{}) / 8
+	buf := make([]uint64, headerWords+fiemapBatchSize*unsafe.Sizeof(fiemapExtent{})/8)
+	request := (*fiemap)(unsafe.Pointer(&buf[0]))
+	request.start = uint64(offset)
+	request.length = ^uint64(0) - uint64(offset)
+	request.extentCount = fiemapBatchSize
+	if !f.fetched {
+		request.flags = fiemapFlagSync
+	}
+
+	conn, err := f.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	connerr := conn.Control(func(fd uintptr) {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, fsIocFiemap, uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			err = syscall.Errno(errno)
+		}
+	})
+
+	if connerr != nil {
+		return connerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	extents := (*[fiemapBatchSize]fiemapExtent)(unsafe.Pointer(&buf[headerWords]))[:request.mappedExtents]
+
+	f.size = size
+	f.fetched = true
+	f.batchStart = offset
+	f.batchEnd = offset
+	f.last = len(extents) == 0
+	f.extents = f.extents[:0]
+
+	for _, extent := range extents {
+		f.batchEnd = int64(extent.logical + extent.length)
+		if extent.flags&fiemapExtentLast != 0 {
+			f.last = true
+		}
+
+		// unwritten extents are allocated but read as zeros
+		if extent.flags&fiemapExtentUnwritten != 0 {
+			continue
+		}
+
+		// merge adjacent extents to prevent needlessly splitting data sections
+		if len(f.extents) > 0 {
+			previous := &f.extents[len(f.extents)-1]
+			if previous.Offset+previous.Length == int64(extent.logical) {
+				previous.Length += int64(extent.length)
+				continue
+			}
+		}
+
+		f.extents = append(f.extents, Extent{Offset: int64(extent.logical), Length: int64(extent.length)})
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package sparsecat
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFiemapSource(t *testing.T) {
+	const blockSize = 4096
+
+	// every other block contains data, so there are more extents than fit in a single batch
+	blocks := map[int64]byte{}
+	for block := int64(0); block < 3*fiemapBatchSize; block += 2 {
+		blocks[block] = byte(block)
+	}
+
+	size := int64(8 * fiemapBatchSize * blockSize)
+	file := sparseFile(t, "source", size, blockSize, blocks)
+
+	// an allocated but unwritten range reads as zeros
+	allocated := Extent{Offset: 4 * fiemapBatchSize * blockSize, Length: 64 * blockSize}
+	err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, allocated.Offset, allocated.Length)
+	if err != nil {
+		t.Skipf("fallocate isn't supported: %s", err)
+	}
+
+	source := NewFiemapSource(file)
+	extents := collectExtents(t, source)
+
+	fiemap := source.(*fiemapSource)
+	if fiemap.unsupported {
+		t.Skip("the filesystem doesn't support FIEMAP")
+	}
+
+	if fiemap.batchStart == 0 {
+		t.Error("expected the extents to be fetched in several batches")
+	}
+
+	for block := range blocks {
+		written := Extent{Offset: block * blockSize, Length: blockSize}
+		if !coversExtent(extents, written) {
+			t.Errorf("the data at %d-%d isn't reported, got extents %v", written.Offset, written.Offset+written.Length, extents)
+		}
+	}
+
+	for _, extent := range extents {
+		if extent.Offset < allocated.Offset+allocated.Length && extent.Offset+extent.Length > allocated.Offset {
+			t.Errorf("extent %d-%d overlaps the unwritten range", extent.Offset, extent.Offset+extent.Length)
+		}
+	}
+}
+
+func TestFiemapSourceFallback(t *testing.T) {
+	const blockSize = 4096
+
+	// tmpfs doesn't support FIEMAP but does support SEEK_DATA and SEEK_HOLE
+	dir, err := os.MkdirTemp("/dev/shm", "sparsecat-")
+	if err != nil {
+		t.Skipf("unable to use /dev/shm: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := os.Create(dir + "/source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	err = file.Truncate(16 * blockSize)
+	if err == nil {
+		_, err = file.WriteAt(make([]byte, blockSize), 0)
+	}
+	if err == nil {
+		_, err = file.WriteAt([]byte{1}, 8*blockSize)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := NewFiemapSource(file)
+	extents := collectExtents(t, source)
+
+	if !source.(*fiemapSource).unsupported {
+		t.Skip("the filesystem of /dev/shm supports FIEMAP")
+	}
+
+	for _, written := range []Extent{{0, blockSize}, {8 * blockSize, 1}} {
+		if !coversExtent(extents, written) {
+			t.Errorf("the data at %d-%d isn't reported, got extents %v", written.Offset, written.Offset+written.Length, extents)
+		}
+	}
+
+	if coversExtent(extents, Extent{Offset: 4 * blockSize, Length: 1}) {
+		t.Errorf("the hole at %d is reported as data, got extents %v", 4*blockSize, extents)
+	}
+}
@@ -0,0 +1,92 @@
+package format
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses the data sections of formats that support compression.
+type Codec interface {
+	Compress(writer io.Writer) (io.WriteCloser, error)
+	Decompress(reader io.Reader) (io.ReadCloser, error)
+}
+
+type registeredCodec struct {
+	id    byte
+	name  string
+	codec Codec
+}
+
+var (
+	codecLock    sync.RWMutex
+	codecsByID   = map[byte]registeredCodec{}
+	codecsByName = map[string]registeredCodec{}
+)
+
+func init() {
+	RegisterCodec(1, "gzip", gzipCodec{})
+	RegisterCodec(2, "flate", flateCodec{})
+}
+
+// RegisterCodec makes a codec available under the given id and name. The id is used on the wire and must be the
+// same on both the sending and receiving side. Id 0 is reserved for uncompressed data. RegisterCodec panics when
+// the id or name is already in use.
+func RegisterCodec(id byte, name string, codec Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	if id == 0 {
+		panic("format: codec id 0 is reserved")
+	}
+
+	if _, exists := codecsByID[id]; exists {
+		panic(fmt.Sprintf("format: codec id %d registered twice", id))
+	}
+
+	if _, exists := codecsByName[name]; exists {
+		panic(fmt.Sprintf("format: codec %s registered twice", name))
+	}
+
+	registered := registeredCodec{id: id, name: name, codec: codec}
+	codecsByID[id] = registered
+	codecsByName[name] = registered
+}
+
+func getCodecByID(id byte) (registeredCodec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+
+	codec, exists := codecsByID[id]
+	return codec, exists
+}
+
+func getCodecByName(name string) (registeredCodec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+
+	codec, exists := codecsByName[name]
+	return codec, exists
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(writer io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(writer), nil
+}
+
+func (gzipCodec) Decompress(reader io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(reader)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Compress(writer io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(writer, flate.DefaultCompression)
+}
+
+func (flateCodec) Decompress(reader io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(reader), nil
+}
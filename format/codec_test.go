@@ -0,0 +1,213 @@
+package format
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressedRoundTrip(t *testing.T) {
+	const size = 1 << 20
+
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	sections := []testSection{
+		{Section: Section{Offset: 0, Length: 64 * 1024}, data: bytes.Repeat([]byte("sparsecat"), 64*1024/9+1)[:64*1024]},
+		// incompressible data is sent uncompressed
+		{Section: Section{Offset: 128 * 1024, Length: 4096}, data: random},
+		{Section: Section{Offset: 256 * 1024, Length: 4096, Zero: true}},
+		{Section: Section{Offset: 512 * 1024, Length: 100}, data: bytes.Repeat([]byte{1}, 100)},
+	}
+
+	for _, codec := range []string{"gzip", "flate"} {
+		t.Run(codec, func(t *testing.T) {
+			f, err := NewSparsecatV1(codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stream := encodeStream(t, f, size, sections)
+
+			uncompressed := encodeStream(t, SparsecatV1, size, sections)
+			if len(stream) >= len(uncompressed) {
+				t.Errorf("compressed stream of %d bytes isn't smaller than the uncompressed stream of %d bytes", len(stream), len(uncompressed))
+			}
+
+			// the digest doesn't depend on the compression
+			if !bytes.Equal(stream[len(stream)-32:], uncompressed[len(uncompressed)-32:]) {
+				t.Error("the digest of the compressed stream differs")
+			}
+
+			// streams of any codec can be read by the uncompressed format
+			for _, reader := range []Format{f, SparsecatV1} {
+				file, err := decodeStream(reader, stream)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(file, testFile(size, sections)) {
+					t.Error("decoded file doesn't match")
+				}
+			}
+		})
+	}
+}
+
+// compressedStream returns a sparsecat-v1 stream of a file of size bytes containing a single compressed section
+// with the given codec id and compressed data. The checksum is calculated over data.
+func compressedStream(size int64, section Section, codec byte, compressed []byte, data []byte) []byte {
+	var stream bytes.Buffer
+	stream.WriteString(sparsecatV1Header)
+	stream.WriteByte(sizeIndicator)
+	_ = binary.Write(&stream, binary.LittleEndian, uint64(size))
+
+	header := sectionHeader(compressedIndicator, section)
+	header = append(header, codec)
+	header = append(header, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(header[1+8+8+1:], uint64(len(compressed)))
+
+	stream.Write(header)
+	stream.Write(compressed)
+	stream.Write(checksumTrailer(crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, data)))
+
+	file := make([]byte, size)
+	copy(file[section.Offset:], data)
+	digest := sha256.Sum256(file)
+	stream.WriteByte(endIndicator)
+	stream.Write(digest[:])
+
+	return stream.Bytes()
+}
+
+// gzipData compresses data using gzip
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCompressedSectionErrors(t *testing.T) {
+	const size = 1 << 20
+
+	data := bytes.Repeat([]byte{1}, 1000)
+	section := Section{Offset: 4096, Length: int64(len(data))}
+
+	tests := []struct {
+		name   string
+		stream []byte
+		// err is part of the expected error, empty when the stream is valid
+		err string
+	}{
+		{
+			name:   "valid",
+			stream: compressedStream(size, section, 1, gzipData(t, data), data),
+		},
+		{
+			name:   "unknown codec",
+			stream: compressedStream(size, section, 200, gzipData(t, data), data),
+			err:    "unknown codec 200",
+		},
+		{
+			name:   "wrong codec",
+			stream: compressedStream(size, section, 2, gzipData(t, data), data),
+			err:    "decompressing",
+		},
+		{
+			name: "compressed data larger than a section",
+			stream: compressedStream(size, section, 1,
+				append(gzipData(t, data), make([]byte, compressedSectionSize)...), data),
+			err: "is larger than",
+		},
+		{
+			name: "section larger than a compressed section",
+			stream: compressedStream(compressedSectionSize*2, Section{Offset: 0, Length: compressedSectionSize + 1}, 1,
+				gzipData(t, make([]byte, compressedSectionSize+1)), make([]byte, compressedSectionSize+1)),
+			err: "is larger than",
+		},
+		{
+			name:   "decompression bomb",
+			stream: compressedStream(size, section, 1, gzipData(t, make([]byte, 64<<20)), data),
+			err:    "contains more than 1000 bytes",
+		},
+		{
+			name:   "decompressed data too short",
+			stream: compressedStream(size, section, 1, gzipData(t, data[:500]), data),
+			err:    "unexpected EOF",
+		},
+		{
+			name:   "corrupt compressed data",
+			stream: compressedStream(size, section, 1, bytes.Repeat([]byte{0xff}, 100), data),
+			err:    "decompressing",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := decodeStream(SparsecatV1, test.stream)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(file[section.Offset:section.Offset+section.Length], data) {
+					t.Error("decoded file doesn't match")
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestCodecRegistry(t *testing.T) {
+	_, err := NewSparsecatV1("unknown")
+	if err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+
+	compressing, ok := SparsecatV1.(CompressingFormat)
+	if !ok {
+		t.Fatal("sparsecat-v1 doesn't support compression")
+	}
+
+	_, err = compressing.WithCodec("gzip")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, register := range []func(){
+		func() { RegisterCodec(0, "reserved", gzipCodec{}) },
+		func() { RegisterCodec(1, "gzip2", gzipCodec{}) },
+		func() { RegisterCodec(100, "gzip", gzipCodec{}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected registering the codec to panic")
+				}
+			}()
+
+			register()
+		}()
+	}
+}
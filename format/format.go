@@ -1,15 +1,36 @@
 package format
 
-import "io"
+import (
+	"bytes"
+	"io"
+)
 
 type Section struct {
-	Offset, Length int64
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// Zero marks a section that must read as zeros, for example because it was discarded in a diff. No data is
+	// sent for zero sections.
+	Zero bool `json:"zero,omitempty"`
+}
+
+// Header contains the information sent at the start of a stream.
+type Header struct {
+	// Size is the size of the file.
+	Size int64 `json:"size"`
+	// FromSnapshot is the name of the snapshot a diff starts from. It is empty for a diff containing an entire image.
+	FromSnapshot string `json:"fromSnapshot,omitempty"`
+	// ToSnapshot is the name of the snapshot a diff ends at. It is empty when a diff ends at the current state of an
+	// image.
+	ToSnapshot string `json:"toSnapshot,omitempty"`
 }
 
 // Format defines the wire format function. ReadFileSize and ReadSectionHeader are used
 // for parsing incoming data whereas the GetFileSizeReader, GetSectionReader and GetEndTagReader
 // functions are used to create readers that can be used by io.Copy. The length returned by these
 // functions must be the amount of bytes the reader will return before reaching io.EOF.
+//
+// Sections with Zero set are returned by ReadSectionHeader for zero records. They aren't followed by any data.
+// GetSectionReader is passed a nil source for zero sections and must write a zero record.
 type Format interface {
 	// ReadFileSize reads the file size from an incoming stream
 	ReadFileSize(reader io.Reader) (int64, error)
@@ -23,9 +44,112 @@ type Format interface {
 	GetEndTagReader() (reader io.Reader, length int64)
 }
 
+// StreamFormat is implemented by formats that keep state for the duration of a single stream, such as a running
+// checksum. NewStream is called at the start of every stream and the returned Format is used for the rest of it.
+type StreamFormat interface {
+	Format
+	NewStream() Format
+}
+
+// SectionDataReader is implemented by formats that frame the data of a section, for example by appending a
+// checksum. GetSectionDataReader must return a reader that yields exactly section.Length bytes of data read
+// from the incoming stream.
+type SectionDataReader interface {
+	GetSectionDataReader(reader io.Reader, section Section) io.Reader
+}
+
+// SectionSizeLimiter is implemented by formats that can't handle arbitrarily large sections, for example
+// because they have to buffer a section in memory. The Encoder never creates sections larger than MaxSectionSize.
+// A size of 0 means there is no limit.
+type SectionSizeLimiter interface {
+	MaxSectionSize() int64
+}
+
+// HeaderFormat is implemented by formats that send more than the file size at the start of a stream, such as the
+// snapshot names of rbd diffs.
+type HeaderFormat interface {
+	// ReadHeader reads the header from an incoming stream
+	ReadHeader(reader io.Reader) (Header, error)
+	GetHeaderReader(header Header) (reader io.Reader, length int64)
+}
+
+// CompressingFormat is implemented by formats that can compress their data sections.
+type CompressingFormat interface {
+	// WithCodec returns the format compressing every data section using the codec registered under codecName
+	WithCodec(codecName string) (Format, error)
+}
+
+// DiffChainFormat is implemented by formats whose streams can contain several consecutive diffs.
+type DiffChainFormat interface {
+	// LastHeader returns the header of the last diff read from an incoming stream
+	LastHeader() Header
+}
+
+// ReadHeader reads the header of a stream. Formats that don't implement HeaderFormat only provide the file size.
+func ReadHeader(f Format, reader io.Reader) (Header, error) {
+	if headerFormat, ok := f.(HeaderFormat); ok {
+		return headerFormat.ReadHeader(reader)
+	}
+
+	size, err := f.ReadFileSize(reader)
+	return Header{Size: size}, err
+}
+
+// GetHeaderReader returns a reader for the header of a stream. Formats that don't implement HeaderFormat only
+// send the file size.
+func GetHeaderReader(f Format, header Header) (reader io.Reader, length int64) {
+	if headerFormat, ok := f.(HeaderFormat); ok {
+		return headerFormat.GetHeaderReader(header)
+	}
+
+	return f.GetFileSizeReader(uint64(header.Size))
+}
+
+// ReaderError returns the error of a reader returned by a Format that failed to create it, for example because the
+// data of a section couldn't be read from the source. Such readers fail on the first Read and their length is 0.
+// nil is returned for any other reader.
+func ReaderError(reader io.Reader) error {
+	if failed, ok := reader.(errorReader); ok {
+		return failed.err
+	}
+	return nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for reads within a record. Only running out of data in
+// between records may be reported as the end of a stream.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ForStream returns the Format to use for a single stream of f.
+func ForStream(f Format) Format {
+	if stream, ok := f.(StreamFormat); ok {
+		return stream.NewStream()
+	}
+	return f
+}
+
+// GetSectionDataReader returns a reader for the data of section. The data is read directly from reader
+// unless f implements SectionDataReader. Zero sections don't have any data.
+func GetSectionDataReader(f Format, reader io.Reader, section Section) io.Reader {
+	if section.Zero {
+		return bytes.NewReader(nil)
+	}
+
+	if dataReader, ok := f.(SectionDataReader); ok {
+		return dataReader.GetSectionDataReader(reader, section)
+	}
+	return io.LimitReader(reader, section.Length)
+}
+
 var formats = map[string]Format{
-	"rbd-diff-v1": RbdDiffv1,
-	"rbd-diff-v2": RbdDiffv2,
+	"rbd-diff-v1":   RbdDiffv1,
+	"rbd-diff-v2":   RbdDiffv2,
+	"rbd-export-v2": RbdExportv2,
+	"sparsecat-v1":  SparsecatV1,
 }
 
 func GetByName(name string) (format Format, exists bool) {
@@ -8,31 +8,61 @@ import (
 )
 
 const (
-	sizeIndicator byte = 's'
-	dataIndicator byte = 'w'
-	endIndicator  byte = 'e'
+	fromSnapIndicator byte = 'f'
+	toSnapIndicator   byte = 't'
+	sizeIndicator     byte = 's'
+	dataIndicator     byte = 'w'
+	zeroIndicator     byte = 'z'
+	endIndicator      byte = 'e'
+
+	// maxSnapshotNameLength guards against allocating huge buffers for corrupt snapshot names
+	maxSnapshotNameLength = 64 * 1024
 )
 
 // RbdDiffv1 implements the rbd diff v1 wire format as described by https://github.com/ceph/ceph/blob/master/doc/dev/rbd-diff.rst#header.
-// Only the Size, UpdatedData and End sections are implemented. Zero data is simply not transmitted.
+// The snapshot names of the header are available through ReadHeader. Zero data is read as zero sections, but the
+// Encoder simply doesn't transmit holes.
 var RbdDiffv1 rbdDiffv1
 
 type rbdDiffv1 struct{}
 
 func (r rbdDiffv1) ReadFileSize(reader io.Reader) (int64, error) {
-	// 1 byte for segment type. 8 bytes for int64
-	var header [1 + 8]byte
-	_, err := io.ReadFull(reader, header[:])
-	if err != nil {
-		return 0, err
-	}
+	header, err := r.ReadHeader(reader)
+	return header.Size, err
+}
 
-	if header[0] != sizeIndicator {
-		return 0, fmt.Errorf("invalid header. Expected size segment but got %s", string(header[0]))
-	}
+func (r rbdDiffv1) ReadHeader(reader io.Reader) (Header, error) {
+	var header Header
+	for {
+		// 1 byte for segment type. 8 bytes for int64
+		var record [1 + 8]byte
+		// the header ends with the size record, a stream can't end before it
+		_, err := io.ReadFull(reader, record[:1])
+		if err != nil {
+			return header, unexpectedEOF(err)
+		}
+
+		switch record[0] {
+		case fromSnapIndicator:
+			header.FromSnapshot, err = readSnapshotName(reader)
+		case toSnapIndicator:
+			header.ToSnapshot, err = readSnapshotName(reader)
+		case sizeIndicator:
+			_, err = io.ReadFull(reader, record[1:])
+			if err != nil {
+				return header, unexpectedEOF(err)
+			}
+
+			header.Size = int64(binary.LittleEndian.Uint64(record[1:]))
+			return header, nil
+		default:
+			return header, fmt.Errorf("invalid header. Expected size segment but got %s", string(record[0]))
+		}
 
-	size := binary.LittleEndian.Uint64(header[1:])
-	return int64(size), nil
+		if err != nil {
+			return header, err
+		}
+	}
 }
 
 func (r rbdDiffv1) ReadSectionHeader(reader io.Reader) (Section, error) {
@@ -43,16 +73,18 @@ func (r rbdDiffv1) ReadSectionHeader(reader io.Reader) (Section, error) {
 	// first byte contains the segment type
 	_, err := io.ReadFull(reader, segmentHeader[0:1])
 	if err != nil {
-		return Section{}, fmt.Errorf("error reading segmentHeader header: %w", err)
+		// the end of a stream is marked by an end tag, running out of data is unexpected
+		return Section{}, fmt.Errorf("error reading segmentHeader header: %w", unexpectedEOF(err))
 	}
 
 	switch segmentHeader[0] {
 	case endIndicator:
 		return Section{}, io.EOF
-	case dataIndicator:
+	case dataIndicator, zeroIndicator:
+		indicator := segmentHeader[0]
 		_, err = io.ReadFull(reader, segmentHeader[:])
 		if err != nil {
-			return Section{}, fmt.Errorf("error reading data header: %w", err)
+			return Section{}, fmt.Errorf("error reading data header: %w", unexpectedEOF(err))
 		}
 
 		offset := int64(binary.LittleEndian.Uint64(segmentHeader[:9]))
@@ -61,6 +93,7 @@ func (r rbdDiffv1) ReadSectionHeader(reader io.Reader) (Section, error) {
 		return Section{
 			Offset: offset,
 			Length: length,
+			Zero:   indicator == zeroIndicator,
 		}, nil
 	}
 
@@ -68,10 +101,27 @@ func (r rbdDiffv1) ReadSectionHeader(reader io.Reader) (Section, error) {
 }
 
 func (r rbdDiffv1) GetFileSizeReader(size uint64) (reader io.Reader, length int64) {
-	buf := make([]byte, 1+8)
-	buf[0] = sizeIndicator
-	binary.LittleEndian.PutUint64(buf[1:], size)
-	return bytes.NewReader(buf), 1 + 8
+	return r.GetHeaderReader(Header{Size: int64(size)})
+}
+
+func (r rbdDiffv1) GetHeaderReader(header Header) (reader io.Reader, length int64) {
+	var buf bytes.Buffer
+	if header.FromSnapshot != "" {
+		buf.WriteByte(fromSnapIndicator)
+		writeSnapshotName(&buf, header.FromSnapshot)
+	}
+
+	if header.ToSnapshot != "" {
+		buf.WriteByte(toSnapIndicator)
+		writeSnapshotName(&buf, header.ToSnapshot)
+	}
+
+	var size [1 + 8]byte
+	size[0] = sizeIndicator
+	binary.LittleEndian.PutUint64(size[1:], uint64(header.Size))
+	buf.Write(size[:])
+
+	return &buf, int64(buf.Len())
 }
 
 func (r rbdDiffv1) GetSectionReader(source io.Reader, section Section) (reader io.Reader, length int64) {
@@ -81,6 +131,13 @@ func (r rbdDiffv1) GetSectionReader(source io.Reader, section Section) (reader i
 	buf := make([]byte, headerSize)
 	buf[0] = dataIndicator
 
+	if section.Zero {
+		buf[0] = zeroIndicator
+		binary.LittleEndian.PutUint64(buf[1:], uint64(section.Offset))
+		binary.LittleEndian.PutUint64(buf[1+8:], uint64(section.Length))
+		return bytes.NewReader(buf), headerSize
+	}
+
 	binary.LittleEndian.PutUint64(buf[1:], uint64(section.Offset))
 	binary.LittleEndian.PutUint64(buf[1+8:], uint64(section.Length))
 
@@ -95,25 +152,49 @@ func (r rbdDiffv1) GetEndTagReader() (reader io.Reader, length int64) {
 }
 
 // RbdDiffv2 implements the rbd diff v2 wire format as described by https://github.com/ceph/ceph/blob/master/doc/dev/rbd-diff.rst#header-1.
-// Only the Size, UpdatedData and End sections are implemented. Zero data is simply not transmitted.
+// The snapshot names of the header are available through ReadHeader. Zero data is read as zero sections, but the
+// Encoder simply doesn't transmit holes.
 var RbdDiffv2 rbdDiffv2
 
 type rbdDiffv2 struct{}
 
 func (r rbdDiffv2) ReadFileSize(reader io.Reader) (int64, error) {
-	// 1 byte for segment type. 8 bytes for int64
-	var header [1 + 8 + 8]byte
-	_, err := io.ReadFull(reader, header[:])
-	if err != nil {
-		return 0, err
-	}
+	header, err := r.ReadHeader(reader)
+	return header.Size, err
+}
 
-	if header[0] != sizeIndicator {
-		return 0, fmt.Errorf("invalid header. Expected size segment but got %s", string(header[0]))
-	}
+func (r rbdDiffv2) ReadHeader(reader io.Reader) (Header, error) {
+	var header Header
+	for {
+		// 1 byte for segment type. 8 bytes for the length of the segment and 8 bytes for int64
+		var record [1 + 8 + 8]byte
+		// the header ends with the size record, a stream can't end before it
+		_, err := io.ReadFull(reader, record[:1+8])
+		if err != nil {
+			return header, unexpectedEOF(err)
+		}
+
+		switch record[0] {
+		case fromSnapIndicator:
+			header.FromSnapshot, err = readSnapshotName(reader)
+		case toSnapIndicator:
+			header.ToSnapshot, err = readSnapshotName(reader)
+		case sizeIndicator:
+			_, err = io.ReadFull(reader, record[1+8:])
+			if err != nil {
+				return header, unexpectedEOF(err)
+			}
+
+			header.Size = int64(binary.LittleEndian.Uint64(record[1+8:]))
+			return header, nil
+		default:
+			return header, fmt.Errorf("invalid header. Expected size segment but got %s", string(record[0]))
+		}
 
-	size := binary.LittleEndian.Uint64(header[9:])
-	return int64(size), nil
+		if err != nil {
+			return header, err
+		}
+	}
 }
 
 func (r rbdDiffv2) ReadSectionHeader(reader io.Reader) (Section, error) {
@@ -124,16 +205,18 @@ func (r rbdDiffv2) ReadSectionHeader(reader io.Reader) (Section, error) {
 	// first byte contains the segment type
 	_, err := io.ReadFull(reader, segmentHeader[0:1])
 	if err != nil {
-		return Section{}, fmt.Errorf("error reading segmentHeader header: %w", err)
+		// the end of a stream is marked by an end tag, running out of data is unexpected
+		return Section{}, fmt.Errorf("error reading segmentHeader header: %w", unexpectedEOF(err))
 	}
 
 	switch segmentHeader[0] {
 	case endIndicator:
 		return Section{}, io.EOF
-	case dataIndicator:
+	case dataIndicator, zeroIndicator:
+		indicator := segmentHeader[0]
 		_, err = io.ReadFull(reader, segmentHeader[:])
 		if err != nil {
-			return Section{}, fmt.Errorf("error reading data header: %w", err)
+			return Section{}, fmt.Errorf("error reading data header: %w", unexpectedEOF(err))
 		}
 
 		// ignore the first int64 as we don't actually need that
@@ -143,6 +226,7 @@ func (r rbdDiffv2) ReadSectionHeader(reader io.Reader) (Section, error) {
 		return Section{
 			Offset: offset,
 			Length: length,
+			Zero:   indicator == zeroIndicator,
 		}, nil
 	}
 
@@ -150,11 +234,34 @@ func (r rbdDiffv2) ReadSectionHeader(reader io.Reader) (Section, error) {
 }
 
 func (r rbdDiffv2) GetFileSizeReader(size uint64) (reader io.Reader, length int64) {
-	buf := make([]byte, 1+8+8)
-	buf[0] = sizeIndicator
-	binary.LittleEndian.PutUint64(buf[1:], 8)
-	binary.LittleEndian.PutUint64(buf[1+8:], size)
-	return bytes.NewReader(buf), 1 + 8 + 8
+	return r.GetHeaderReader(Header{Size: int64(size)})
+}
+
+func (r rbdDiffv2) GetHeaderReader(header Header) (reader io.Reader, length int64) {
+	var buf bytes.Buffer
+	writeName := func(indicator byte, name string) {
+		var record [1 + 8]byte
+		record[0] = indicator
+		binary.LittleEndian.PutUint64(record[1:], uint64(4+len(name)))
+		buf.Write(record[:])
+		writeSnapshotName(&buf, name)
+	}
+
+	if header.FromSnapshot != "" {
+		writeName(fromSnapIndicator, header.FromSnapshot)
+	}
+
+	if header.ToSnapshot != "" {
+		writeName(toSnapIndicator, header.ToSnapshot)
+	}
+
+	var size [1 + 8 + 8]byte
+	size[0] = sizeIndicator
+	binary.LittleEndian.PutUint64(size[1:], 8)
+	binary.LittleEndian.PutUint64(size[1+8:], uint64(header.Size))
+	buf.Write(size[:])
+
+	return &buf, int64(buf.Len())
 }
 
 func (r rbdDiffv2) GetSectionReader(source io.Reader, section Section) (reader io.Reader, length int64) {
@@ -164,6 +271,14 @@ func (r rbdDiffv2) GetSectionReader(source io.Reader, section Section) (reader i
 	buf := make([]byte, headerSize)
 	buf[0] = dataIndicator
 
+	if section.Zero {
+		buf[0] = zeroIndicator
+		binary.LittleEndian.PutUint64(buf[1:], 16)
+		binary.LittleEndian.PutUint64(buf[1+8:], uint64(section.Offset))
+		binary.LittleEndian.PutUint64(buf[1+8+8:], uint64(section.Length))
+		return bytes.NewReader(buf), headerSize
+	}
+
 	binary.LittleEndian.PutUint64(buf[1:], 16+uint64(section.Length))
 	binary.LittleEndian.PutUint64(buf[1+8:], uint64(section.Offset))
 	binary.LittleEndian.PutUint64(buf[1+8+8:], uint64(section.Length))
@@ -177,3 +292,33 @@ func (r rbdDiffv2) GetSectionReader(source io.Reader, section Section) (reader i
 func (r rbdDiffv2) GetEndTagReader() (reader io.Reader, length int64) {
 	return bytes.NewReader([]byte{endIndicator}), 1
 }
+
+// readSnapshotName reads a snapshot name prefixed by its le32 length
+func readSnapshotName(reader io.Reader) (string, error) {
+	var length [4]byte
+	_, err := io.ReadFull(reader, length[:])
+	if err != nil {
+		return "", fmt.Errorf("error reading snapshot name: %w", unexpectedEOF(err))
+	}
+
+	nameLength := binary.LittleEndian.Uint32(length[:])
+	if nameLength > maxSnapshotNameLength {
+		return "", fmt.Errorf("snapshot name of %d bytes is too long", nameLength)
+	}
+
+	name := make([]byte, nameLength)
+	_, err = io.ReadFull(reader, name)
+	if err != nil {
+		return "", fmt.Errorf("error reading snapshot name: %w", unexpectedEOF(err))
+	}
+
+	return string(name), nil
+}
+
+// writeSnapshotName writes a snapshot name prefixed by its le32 length
+func writeSnapshotName(buf *bytes.Buffer, name string) {
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(name)))
+	buf.Write(length[:])
+	buf.WriteString(name)
+}
@@ -0,0 +1,35 @@
+package format
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRbdDiffTruncated(t *testing.T) {
+	for _, f := range []Format{RbdDiffv1, RbdDiffv2} {
+		stream := encodeStream(t, f, 100_000, sparsecatTestSections())
+
+		for length := 0; length < len(stream); length++ {
+			_, err := decodeStream(f, stream[:length])
+			if err == nil {
+				t.Errorf("%T: expected an error for a stream truncated to %d bytes", f, length)
+			}
+		}
+
+		// running out of data within the header isn't the end of an empty stream either
+		header, _ := GetHeaderReader(f, Header{Size: 100_000, FromSnapshot: "snap1", ToSnapshot: "snap2"})
+		headerData, err := io.ReadAll(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for length := 1; length < len(headerData); length++ {
+			_, err := ReadHeader(f, bytes.NewReader(headerData[:length]))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%T: expected an unexpected EOF for a header truncated to %d bytes, got %v", f, length, err)
+			}
+		}
+	}
+}
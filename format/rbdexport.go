@@ -0,0 +1,310 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	rbdImageHeader      = "rbd image v2\n"
+	rbdImageDiffsHeader = "rbd image diffs v2\n"
+	rbdDiffv2Header     = "rbd diff v2\n"
+
+	imageOrderIndicator       byte = 'O'
+	imageFeaturesIndicator    byte = 'T'
+	imageStripeUnitIndicator  byte = 'U'
+	imageStripeCountIndicator byte = 'C'
+	imageEndIndicator         byte = 'E'
+
+	// rbdExportMaxSectionSize keeps sections small enough for rbd import to handle comfortably
+	rbdExportMaxSectionSize = 16_000_000
+)
+
+// RbdImageOptions contains the image metadata of an rbd export-format 2 stream. Zero values are replaced by the
+// defaults of rbd: an object size of 4MiB, the layering, exclusive-lock, object-map, fast-diff and deep-flatten
+// features and no striping.
+type RbdImageOptions struct {
+	// Order is the object size of the image as a power of two.
+	Order uint64
+	// Features is the feature bitmask of the image.
+	Features uint64
+	// StripeUnit is the stripe unit in bytes. Defaults to the object size.
+	StripeUnit uint64
+	// StripeCount is the amount of objects a stripe is spread over.
+	StripeCount uint64
+}
+
+// RbdExportv2 implements the rbd export-format 2 wire format as described by
+// https://github.com/ceph/ceph/blob/master/doc/dev/rbd-export.rst. Streams can be imported using
+// `rbd import --export-format 2`. The image is written as a single diff using the rbd diff v2 format.
+// Streams containing multiple diffs can be read as long as the image size doesn't change between them.
+//
+// Like SparsecatV1, RbdExportv2 itself doesn't keep any state. Every stream is handled by the Format returned by
+// ForStream and using RbdExportv2 directly results in an error.
+var RbdExportv2 = NewRbdExportv2(RbdImageOptions{})
+
+// NewRbdExportv2 returns the rbd export-format 2 wire format writing the image metadata in options.
+func NewRbdExportv2(options RbdImageOptions) Format {
+	if options.Order == 0 {
+		options.Order = 22
+	}
+
+	if options.Features == 0 {
+		options.Features = 61
+	}
+
+	if options.StripeUnit == 0 {
+		options.StripeUnit = 1 << options.Order
+	}
+
+	if options.StripeCount == 0 {
+		options.StripeCount = 1
+	}
+
+	return &rbdExportv2{options: options}
+}
+
+// rbdExportv2 is the configuration of the format, shared by all of its streams
+type rbdExportv2 struct {
+	options RbdImageOptions
+}
+
+func (r *rbdExportv2) NewStream() Format {
+	return &rbdExportv2Stream{options: r.options}
+}
+
+func (r *rbdExportv2) MaxSectionSize() int64 {
+	return rbdExportMaxSectionSize
+}
+
+func (r *rbdExportv2) ReadFileSize(io.Reader) (int64, error) {
+	return 0, errNoStream
+}
+
+func (r *rbdExportv2) ReadHeader(io.Reader) (Header, error) {
+	return Header{}, errNoStream
+}
+
+func (r *rbdExportv2) ReadSectionHeader(io.Reader) (Section, error) {
+	return Section{}, errNoStream
+}
+
+func (r *rbdExportv2) GetFileSizeReader(uint64) (reader io.Reader, length int64) {
+	return errorReader{errNoStream}, 0
+}
+
+func (r *rbdExportv2) GetHeaderReader(Header) (reader io.Reader, length int64) {
+	return errorReader{errNoStream}, 0
+}
+
+func (r *rbdExportv2) GetSectionReader(io.Reader, Section) (reader io.Reader, length int64) {
+	return errorReader{errNoStream}, 0
+}
+
+func (r *rbdExportv2) GetEndTagReader() (reader io.Reader, length int64) {
+	return errorReader{errNoStream}, 0
+}
+
+// rbdExportv2Stream is a single stream of the rbd export-format 2 format
+type rbdExportv2Stream struct {
+	// options starts out as the configuration of the format and is replaced by the metadata of an incoming stream
+	options RbdImageOptions
+
+	// header is the header of the diff that is currently being read
+	header Header
+	// diffs is the amount of diffs that haven't been read yet
+	diffs uint64
+}
+
+func (r *rbdExportv2Stream) MaxSectionSize() int64 {
+	return rbdExportMaxSectionSize
+}
+
+func (r *rbdExportv2Stream) ReadFileSize(reader io.Reader) (int64, error) {
+	header, err := r.ReadHeader(reader)
+	return header.Size, err
+}
+
+// ReadHeader reads the image metadata and returns the header of the first diff of the image.
+func (r *rbdExportv2Stream) ReadHeader(reader io.Reader) (Header, error) {
+	err := readString(reader, rbdImageHeader)
+	if err != nil {
+		return Header{}, err
+	}
+
+	err = r.readMetadata(reader)
+	if err != nil {
+		return Header{}, err
+	}
+
+	err = readString(reader, rbdImageDiffsHeader)
+	if err != nil {
+		return Header{}, err
+	}
+
+	var count [8]byte
+	_, err = io.ReadFull(reader, count[:])
+	if err != nil {
+		return Header{}, fmt.Errorf("error reading diff count: %w", unexpectedEOF(err))
+	}
+
+	r.diffs = binary.LittleEndian.Uint64(count[:])
+	if r.diffs == 0 {
+		return Header{}, fmt.Errorf("stream doesn't contain any diffs")
+	}
+
+	r.header, err = r.readDiffHeader(reader)
+	return r.header, err
+}
+
+// readMetadata reads the image metadata records up to and including the end record. The metadata is followed by the
+// diffs, so running out of data is unexpected.
+func (r *rbdExportv2Stream) readMetadata(reader io.Reader) error {
+	for {
+		var tag [1]byte
+		_, err := io.ReadFull(reader, tag[:])
+		if err != nil {
+			return fmt.Errorf("error reading image metadata: %w", unexpectedEOF(err))
+		}
+
+		if tag[0] == imageEndIndicator {
+			return nil
+		}
+
+		var length [8]byte
+		_, err = io.ReadFull(reader, length[:])
+		if err != nil {
+			return fmt.Errorf("error reading image metadata: %w", unexpectedEOF(err))
+		}
+
+		// records that don't contain a number, such as image meta key value pairs, are skipped
+		valueLength := binary.LittleEndian.Uint64(length[:])
+		if valueLength != 8 {
+			_, err = io.CopyN(io.Discard, reader, int64(valueLength))
+			if err != nil {
+				return fmt.Errorf("error reading image metadata: %w", unexpectedEOF(err))
+			}
+			continue
+		}
+
+		var value [8]byte
+		_, err = io.ReadFull(reader, value[:])
+		if err != nil {
+			return fmt.Errorf("error reading image metadata: %w", unexpectedEOF(err))
+		}
+
+		number := binary.LittleEndian.Uint64(value[:])
+		switch tag[0] {
+		case imageOrderIndicator:
+			r.options.Order = number
+		case imageFeaturesIndicator:
+			r.options.Features = number
+		case imageStripeUnitIndicator:
+			r.options.StripeUnit = number
+		case imageStripeCountIndicator:
+			r.options.StripeCount = number
+		}
+	}
+}
+
+// readDiffHeader reads the header of the next diff in the stream
+func (r *rbdExportv2Stream) readDiffHeader(reader io.Reader) (Header, error) {
+	err := readString(reader, rbdDiffv2Header)
+	if err != nil {
+		return Header{}, err
+	}
+
+	r.diffs--
+	return RbdDiffv2.ReadHeader(reader)
+}
+
+func (r *rbdExportv2Stream) ReadSectionHeader(reader io.Reader) (Section, error) {
+	for {
+		section, err := RbdDiffv2.ReadSectionHeader(reader)
+		if !errors.Is(err, io.EOF) || r.diffs == 0 {
+			return section, err
+		}
+
+		// continue with the next diff of the image
+		header, err := r.readDiffHeader(reader)
+		if err != nil {
+			return Section{}, err
+		}
+
+		if header.Size != r.header.Size {
+			return Section{}, fmt.Errorf("image size changes from %d to %d between diffs", r.header.Size, header.Size)
+		}
+
+		if header.FromSnapshot != r.header.ToSnapshot {
+			return Section{}, fmt.Errorf("diff from snapshot %q doesn't follow the diff to snapshot %q", header.FromSnapshot, r.header.ToSnapshot)
+		}
+
+		r.header = header
+	}
+}
+
+// LastHeader returns the header of the diff the last section was read from.
+func (r *rbdExportv2Stream) LastHeader() Header {
+	return r.header
+}
+
+func (r *rbdExportv2Stream) GetFileSizeReader(size uint64) (reader io.Reader, length int64) {
+	return r.GetHeaderReader(Header{Size: int64(size)})
+}
+
+// GetHeaderReader writes the image metadata followed by the header of a single diff containing the image.
+func (r *rbdExportv2Stream) GetHeaderReader(header Header) (reader io.Reader, length int64) {
+	var buf bytes.Buffer
+	buf.WriteString(rbdImageHeader)
+
+	writeRecord := func(tag byte, value uint64) {
+		var record [1 + 8 + 8]byte
+		record[0] = tag
+		binary.LittleEndian.PutUint64(record[1:], 8)
+		binary.LittleEndian.PutUint64(record[1+8:], value)
+		buf.Write(record[:])
+	}
+
+	writeRecord(imageOrderIndicator, r.options.Order)
+	writeRecord(imageFeaturesIndicator, r.options.Features)
+	writeRecord(imageStripeUnitIndicator, r.options.StripeUnit)
+	writeRecord(imageStripeCountIndicator, r.options.StripeCount)
+	buf.WriteByte(imageEndIndicator)
+
+	// the image is sent as a single diff
+	buf.WriteString(rbdImageDiffsHeader)
+	var count [8]byte
+	binary.LittleEndian.PutUint64(count[:], 1)
+	buf.Write(count[:])
+	buf.WriteString(rbdDiffv2Header)
+
+	headerReader, headerLength := RbdDiffv2.GetHeaderReader(header)
+	return io.MultiReader(&buf, headerReader), int64(buf.Len()) + headerLength
+}
+
+func (r *rbdExportv2Stream) GetSectionReader(source io.Reader, section Section) (reader io.Reader, length int64) {
+	return RbdDiffv2.GetSectionReader(source, section)
+}
+
+func (r *rbdExportv2Stream) GetEndTagReader() (reader io.Reader, length int64) {
+	return RbdDiffv2.GetEndTagReader()
+}
+
+// readString reads expected from reader and returns an error when the stream contains something else. Every string
+// is followed by more records, so running out of data is unexpected.
+func readString(reader io.Reader, expected string) error {
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(reader, buf)
+	if err != nil {
+		return fmt.Errorf("error reading %q: %w", expected, unexpectedEOF(err))
+	}
+
+	if string(buf) != expected {
+		return fmt.Errorf("invalid header. Expected %q but got %q", expected, buf)
+	}
+
+	return nil
+}
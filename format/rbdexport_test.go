@@ -0,0 +1,233 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// rbdExportDiff is a single diff of an rbd export-format 2 test stream
+type rbdExportDiff struct {
+	header   Header
+	sections []testSection
+}
+
+// rbdExportStream writes an rbd export-format 2 stream with the given image order containing diffs, the way
+// `rbd export --export-format 2` does for an image with snapshots
+func rbdExportStream(t *testing.T, order uint64, diffs []rbdExportDiff) []byte {
+	t.Helper()
+
+	var stream bytes.Buffer
+	write := func(reader io.Reader, length int64) {
+		written, err := io.Copy(&stream, reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if written != length {
+			t.Fatalf("expected a reader of %d bytes, got %d", length, written)
+		}
+	}
+
+	writeRecord := func(tag byte, value []byte) {
+		var record [1 + 8]byte
+		record[0] = tag
+		binary.LittleEndian.PutUint64(record[1:], uint64(len(value)))
+		stream.Write(record[:])
+		stream.Write(value)
+	}
+
+	stream.WriteString(rbdImageHeader)
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], order)
+	writeRecord(imageOrderIndicator, value[:])
+	// a record that doesn't contain a number is skipped
+	writeRecord('M', []byte("key value"))
+	stream.WriteByte(imageEndIndicator)
+
+	stream.WriteString(rbdImageDiffsHeader)
+	binary.LittleEndian.PutUint64(value[:], uint64(len(diffs)))
+	stream.Write(value[:])
+
+	for _, diff := range diffs {
+		stream.WriteString(rbdDiffv2Header)
+		write(RbdDiffv2.GetHeaderReader(diff.header))
+		for _, section := range diff.sections {
+			write(RbdDiffv2.GetSectionReader(bytes.NewReader(section.data), section.Section))
+		}
+		write(RbdDiffv2.GetEndTagReader())
+	}
+
+	return stream.Bytes()
+}
+
+func TestRbdExportv2Diffs(t *testing.T) {
+	diffs := []rbdExportDiff{
+		{
+			header: Header{Size: 2000, ToSnapshot: "snap1"},
+			sections: []testSection{
+				{Section: Section{Offset: 100, Length: 50}, data: bytes.Repeat([]byte{1}, 50)},
+				{Section: Section{Offset: 500, Length: 100, Zero: true}},
+			},
+		},
+		{
+			header: Header{Size: 2000, FromSnapshot: "snap1", ToSnapshot: "snap2"},
+			sections: []testSection{
+				// the second diff zeroes part of the data of the first
+				{Section: Section{Offset: 120, Length: 20, Zero: true}},
+				{Section: Section{Offset: 1000, Length: 24}, data: bytes.Repeat([]byte{2}, 24)},
+			},
+		},
+	}
+
+	stream := rbdExportStream(t, 20, diffs)
+
+	f := ForStream(RbdExportv2)
+	reader := bytes.NewReader(stream)
+
+	header, err := ReadHeader(f, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header != diffs[0].header {
+		t.Errorf("expected the header of the first diff %+v, got %+v", diffs[0].header, header)
+	}
+
+	for i, diff := range diffs {
+		for _, expected := range diff.sections {
+			section, err := f.ReadSectionHeader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if section != expected.Section {
+				t.Errorf("expected section %+v, got %+v", expected.Section, section)
+			}
+
+			if last := f.(DiffChainFormat).LastHeader(); last != diff.header {
+				t.Errorf("expected section %+v to be part of diff %d %+v, got %+v", section, i, diff.header, last)
+			}
+
+			_, err = io.CopyN(io.Discard, reader, int64(len(expected.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	_, err = f.ReadSectionHeader(reader)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected the stream to end after the last diff, got %v", err)
+	}
+
+	file, err := decodeStream(RbdExportv2, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testFile(2000, diffs[0].sections)
+	copy(expected[120:140], make([]byte, 20))
+	copy(expected[1000:], diffs[1].sections[1].data)
+	if !bytes.Equal(file, expected) {
+		t.Error("decoded image doesn't match the diffs")
+	}
+
+	// the image metadata of the stream replaces the configuration of the format
+	headerReader, _ := f.GetFileSizeReader(2000)
+	written := make([]byte, len(rbdImageHeader)+1+8+8)
+	_, err = io.ReadFull(headerReader, written)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order := binary.LittleEndian.Uint64(written[len(rbdImageHeader)+1+8:]); order != 20 {
+		t.Errorf("expected the order of the stream to be written, got %d", order)
+	}
+}
+
+func TestRbdExportv2InvalidChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+	}{
+		{name: "size change", header: Header{Size: 3000, FromSnapshot: "snap1", ToSnapshot: "snap2"}},
+		{name: "snapshot mismatch", header: Header{Size: 2000, FromSnapshot: "other", ToSnapshot: "snap2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := rbdExportStream(t, 22, []rbdExportDiff{
+				{header: Header{Size: 2000, ToSnapshot: "snap1"}},
+				{header: test.header},
+			})
+
+			_, err := decodeStream(RbdExportv2, stream)
+			if err == nil {
+				t.Error("expected an error reading the second diff")
+			}
+		})
+	}
+}
+
+func TestRbdExportv2Truncated(t *testing.T) {
+	stream := rbdExportStream(t, 22, []rbdExportDiff{
+		{header: Header{Size: 100_000, ToSnapshot: "snap1"}, sections: sparsecatTestSections()},
+		{header: Header{Size: 100_000, FromSnapshot: "snap1", ToSnapshot: "snap2"}, sections: sparsecatTestSections()},
+	})
+
+	for length := 0; length < len(stream); length++ {
+		_, err := decodeStream(RbdExportv2, stream[:length])
+		if err == nil {
+			t.Errorf("expected an error for a stream truncated to %d bytes", length)
+		}
+	}
+
+	// running out of data within the image metadata or the first diff header is unexpected
+	headerLength := len(rbdImageHeader) + 1 + 8 + 8 + 1 + 8 + len("key value") + 1 + len(rbdImageDiffsHeader) + 8 +
+		len(rbdDiffv2Header) + 1 + 8 + 4 + len("snap1") + 1 + 8 + 8
+	for length := 0; length < headerLength; length++ {
+		_, err := ReadHeader(ForStream(RbdExportv2), bytes.NewReader(stream[:length]))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected an unexpected EOF for a header truncated to %d bytes, got %v", length, err)
+		}
+	}
+}
+
+func TestRbdExportv2Stateless(t *testing.T) {
+	_, err := RbdExportv2.ReadFileSize(bytes.NewReader(nil))
+	if err == nil {
+		t.Error("expected using the global format directly to fail")
+	}
+
+	reader, _ := RbdExportv2.GetFileSizeReader(100)
+	_, err = io.ReadAll(reader)
+	if err == nil {
+		t.Error("expected writing with the global format directly to fail")
+	}
+
+	// reading a stream doesn't change the metadata written by other streams
+	stream := rbdExportStream(t, 20, []rbdExportDiff{{header: Header{Size: 2000}}})
+	_, err = decodeStream(RbdExportv2, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _ = ForStream(NewRbdExportv2(RbdImageOptions{})).GetFileSizeReader(2000)
+	expected, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _ = ForStream(RbdExportv2).GetFileSizeReader(2000)
+	actual, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(actual, expected) {
+		t.Error("expected a new stream to write the default image metadata")
+	}
+}
@@ -0,0 +1,596 @@
+package format
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	sparsecatV1Header = "sparsecat v1\n"
+
+	compressedIndicator byte = 'c'
+
+	// sections are compressed in memory, limit their size to keep memory usage in check
+	compressedSectionSize = 4 << 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError is returned when the CRC32C of a section doesn't match its received header and data.
+type ChecksumError struct {
+	Section          Section
+	Expected, Actual uint32
+}
+
+func (c *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for section at offset %d with length %d. Expected %08x but got %08x",
+		c.Section.Offset, c.Section.Length, c.Expected, c.Actual)
+}
+
+// DigestError is returned when the SHA-256 digest of the entire stream doesn't match the received data.
+type DigestError struct {
+	Expected, Actual []byte
+}
+
+func (d *DigestError) Error() string {
+	return fmt.Sprintf("stream digest mismatch. Expected %s but got %s", hex.EncodeToString(d.Expected), hex.EncodeToString(d.Actual))
+}
+
+// SparsecatV1 implements the native sparsecat wire format. It is similar to RbdDiffv1 but adds integrity checks:
+// every section is followed by a CRC32C of its header and data and the end tag contains the SHA-256 digest of the
+// file. Use NewSparsecatV1 to compress the data sections. Compressed streams can be read by SparsecatV1 as long as
+// the codec has been registered.
+//
+//	header:     "sparsecat v1\n" 's' le64(size)
+//	data:       'w' le64(offset) le64(length) data le32(crc32c)
+//	compressed: 'c' le64(offset) le64(length) u8(codec) le64(compressed length) compressed data le32(crc32c)
+//	zero:       'z' le64(offset) le64(length) le32(crc32c)
+//	end tag:    'e' sha256
+//
+// The checksum of a section is calculated over its header, from the section type up to the data, followed by the
+// uncompressed data. The digest is the SHA-256 of the file of size bytes the stream describes, with zeros wherever
+// it doesn't contain data, so for a stream of an entire file it equals the output of sha256sum. Holes are hashed as
+// runs of zeros, which takes time proportional to the size of the file.
+//
+// Sections must be sent in order. SparsecatV1 itself doesn't keep any state, every stream is handled by the Format
+// returned by ForStream, which the Encoder and Decoder take care of. Using SparsecatV1 directly results in an error.
+var SparsecatV1 Format = &sparsecatV1{}
+
+// errNoStream is returned when the Format methods are called on a format that keeps state for every stream, such as
+// SparsecatV1, instead of a stream of it
+var errNoStream = errors.New("format keeps state for every stream, use the Format returned by ForStream")
+
+// NewSparsecatV1 returns the sparsecat-v1 format that compresses every data section using the codec registered
+// under codecName.
+func NewSparsecatV1(codecName string) (Format, error) {
+	codec, exists := getCodecByName(codecName)
+	if !exists {
+		return nil, fmt.Errorf("codec %s doesn't exist", codecName)
+	}
+
+	return &sparsecatV1{codec: codec}, nil
+}
+
+// WithCodec returns the sparsecat-v1 format compressing every data section using the codec registered under
+// codecName.
+func (s *sparsecatV1) WithCodec(codecName string) (Format, error) {
+	return NewSparsecatV1(codecName)
+}
+
+// sparsecatV1 is the configuration of the format, shared by all of its streams
+type sparsecatV1 struct {
+	codec registeredCodec
+}
+
+func (s *sparsecatV1) NewStream() Format {
+	return &sparsecatV1Stream{codec: s.codec, digest: fileDigest{hash: sha256.New()}}
+}
+
+func (s *sparsecatV1) MaxSectionSize() int64 {
+	if s.codec.codec == nil {
+		return 0
+	}
+	return compressedSectionSize
+}
+
+func (s *sparsecatV1) ReadFileSize(io.Reader) (int64, error) {
+	return 0, errNoStream
+}
+
+func (s *sparsecatV1) ReadSectionHeader(io.Reader) (Section, error) {
+	return Section{}, errNoStream
+}
+
+func (s *sparsecatV1) GetFileSizeReader(uint64) (reader io.Reader, length int64) {
+	return errorReader{errNoStream}, 0
+}
+
+func (s *sparsecatV1) GetSectionReader(io.Reader, Section) (reader io.Reader, length int64) {
+	return errorReader{errNoStream}, 0
+}
+
+func (s *sparsecatV1) GetEndTagReader() (reader io.Reader, length int64) {
+	return errorReader{errNoStream}, 0
+}
+
+// sparsecatV1Stream is a single stream of the sparsecat-v1 format
+type sparsecatV1Stream struct {
+	codec registeredCodec
+
+	size int64
+	// offset is the end of the last section
+	offset int64
+	digest fileDigest
+
+	// the checksum and compression of the section that has been read last
+	sectionCRC            hash.Hash32
+	sectionCodec          registeredCodec
+	sectionCompressedSize int64
+}
+
+func (s *sparsecatV1Stream) MaxSectionSize() int64 {
+	if s.codec.codec == nil {
+		return 0
+	}
+	return compressedSectionSize
+}
+
+func (s *sparsecatV1Stream) ReadFileSize(reader io.Reader) (int64, error) {
+	var header [len(sparsecatV1Header) + 1 + 8]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return 0, err
+	}
+
+	if string(header[:len(sparsecatV1Header)]) != sparsecatV1Header {
+		return 0, fmt.Errorf("invalid header. Expected %q", sparsecatV1Header)
+	}
+
+	if header[len(sparsecatV1Header)] != sizeIndicator {
+		return 0, fmt.Errorf("invalid header. Expected size segment but got %s", string(header[len(sparsecatV1Header)]))
+	}
+
+	size := int64(binary.LittleEndian.Uint64(header[len(sparsecatV1Header)+1:]))
+	s.start(size)
+	return size, nil
+}
+
+func (s *sparsecatV1Stream) ReadSectionHeader(reader io.Reader) (Section, error) {
+	// the largest header is that of compressed sections: char + int64 + int64 + byte + int64
+	var segmentHeader [1 + 8 + 8 + 1 + 8]byte
+
+	_, err := io.ReadFull(reader, segmentHeader[0:1])
+	if err != nil {
+		// the end of a stream is marked by an end tag, running out of data is unexpected
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Section{}, fmt.Errorf("error reading segmentHeader header: %w", err)
+	}
+
+	switch segmentHeader[0] {
+	case endIndicator:
+		var expected [sha256.Size]byte
+		_, err = io.ReadFull(reader, expected[:])
+		if err != nil {
+			return Section{}, fmt.Errorf("error reading stream digest: %w", unexpectedEOF(err))
+		}
+
+		actual := s.digest.sum(s.size)
+		if !bytes.Equal(actual, expected[:]) {
+			return Section{}, &DigestError{Expected: expected[:], Actual: actual}
+		}
+
+		return Section{}, io.EOF
+	case dataIndicator, zeroIndicator:
+		header := segmentHeader[:1+8+8]
+		_, err = io.ReadFull(reader, header[1:])
+		if err != nil {
+			return Section{}, fmt.Errorf("error reading data header: %w", unexpectedEOF(err))
+		}
+
+		section, err := s.readSection(header)
+		if err != nil {
+			return Section{}, err
+		}
+
+		s.sectionCodec = registeredCodec{}
+		if header[0] == dataIndicator {
+			return section, nil
+		}
+
+		// zero sections don't have any data, so their checksum follows the header
+		section.Zero = true
+		err = s.verifyChecksum(reader, section)
+		if err != nil {
+			return Section{}, err
+		}
+
+		return section, nil
+	case compressedIndicator:
+		header := segmentHeader[:]
+		_, err = io.ReadFull(reader, header[1:])
+		if err != nil {
+			return Section{}, fmt.Errorf("error reading compressed data header: %w", unexpectedEOF(err))
+		}
+
+		section, err := s.readSection(header)
+		if err != nil {
+			return Section{}, err
+		}
+
+		codec, exists := getCodecByID(header[1+8+8])
+		if !exists {
+			return Section{}, fmt.Errorf("unknown codec %d", header[1+8+8])
+		}
+
+		// sections are compressed in memory, so neither the section nor its compressed data can be larger
+		compressedSize := binary.LittleEndian.Uint64(header[1+8+8+1:])
+		if section.Length > compressedSectionSize || compressedSize > compressedSectionSize {
+			return Section{}, fmt.Errorf("compressed section at offset %d of %d bytes, %d bytes compressed, is larger than %d bytes",
+				section.Offset, section.Length, compressedSize, compressedSectionSize)
+		}
+
+		s.sectionCodec = codec
+		s.sectionCompressedSize = int64(compressedSize)
+		return section, nil
+	}
+
+	return Section{}, fmt.Errorf(`invalid section type: "%d:" %x`, segmentHeader[0], segmentHeader[0])
+}
+
+// readSection parses the offset and length following the section type of header and starts the checksum of the
+// section. Sections must follow each other in order.
+func (s *sparsecatV1Stream) readSection(header []byte) (Section, error) {
+	section := Section{
+		Offset: int64(binary.LittleEndian.Uint64(header[1:])),
+		Length: int64(binary.LittleEndian.Uint64(header[1+8:])),
+	}
+
+	if section.Offset < s.offset {
+		return Section{}, fmt.Errorf("section at offset %d overlaps previous section ending at %d", section.Offset, s.offset)
+	}
+
+	s.offset = section.Offset + section.Length
+	s.sectionCRC = crc32.New(castagnoli)
+	s.sectionCRC.Write(header)
+	return section, nil
+}
+
+// verifyChecksum reads the CRC32C following a section and compares it to the checksum of the section
+func (s *sparsecatV1Stream) verifyChecksum(reader io.Reader, section Section) error {
+	var trailer [crc32.Size]byte
+	_, err := io.ReadFull(reader, trailer[:])
+	if err != nil {
+		return fmt.Errorf("error reading section checksum: %w", unexpectedEOF(err))
+	}
+
+	expected := binary.LittleEndian.Uint32(trailer[:])
+	if expected != s.sectionCRC.Sum32() {
+		return &ChecksumError{Section: section, Expected: expected, Actual: s.sectionCRC.Sum32()}
+	}
+
+	return nil
+}
+
+func (s *sparsecatV1Stream) GetSectionDataReader(reader io.Reader, section Section) io.Reader {
+	verifier := &verifyingReader{
+		stream:  s,
+		reader:  reader,
+		data:    io.LimitReader(reader, section.Length),
+		section: section,
+	}
+
+	if s.sectionCodec.codec == nil {
+		return verifier
+	}
+
+	verifier.compressed = io.LimitReader(reader, s.sectionCompressedSize)
+	decompressor, err := s.sectionCodec.codec.Decompress(verifier.compressed)
+	if err != nil {
+		return errorReader{fmt.Errorf("error decompressing section: %w", err)}
+	}
+
+	verifier.decompressor = decompressor
+	verifier.data = io.LimitReader(decompressor, section.Length)
+	return verifier
+}
+
+func (s *sparsecatV1Stream) GetFileSizeReader(size uint64) (reader io.Reader, length int64) {
+	s.start(int64(size))
+
+	buf := make([]byte, len(sparsecatV1Header)+1+8)
+	copy(buf, sparsecatV1Header)
+	buf[len(sparsecatV1Header)] = sizeIndicator
+	binary.LittleEndian.PutUint64(buf[len(sparsecatV1Header)+1:], size)
+	return bytes.NewReader(buf), int64(len(buf))
+}
+
+func (s *sparsecatV1Stream) GetSectionReader(source io.Reader, section Section) (reader io.Reader, length int64) {
+	s.offset = section.Offset + section.Length
+
+	if section.Zero {
+		header := sectionHeader(zeroIndicator, section)
+		buf := append(header, checksumTrailer(crc32.Checksum(header, castagnoli))...)
+		return bytes.NewReader(buf), int64(len(buf))
+	}
+
+	if s.codec.codec != nil {
+		return s.getCompressedSectionReader(source, section)
+	}
+
+	header := sectionHeader(dataIndicator, section)
+	dataReader := &checksumReader{
+		data:   io.LimitReader(source, section.Length),
+		crc:    crc32.New(castagnoli),
+		digest: &s.digest,
+		offset: section.Offset,
+	}
+	dataReader.crc.Write(header)
+
+	return io.MultiReader(bytes.NewReader(header), dataReader), int64(len(header)) + section.Length + crc32.Size
+}
+
+// getCompressedSectionReader reads and compresses the entire section. Sections that don't shrink by compressing
+// them are sent uncompressed.
+func (s *sparsecatV1Stream) getCompressedSectionReader(source io.Reader, section Section) (reader io.Reader, length int64) {
+	data := make([]byte, section.Length)
+	_, err := io.ReadFull(source, data)
+	if err != nil {
+		return errorReader{fmt.Errorf("error reading section: %w", err)}, 0
+	}
+
+	var compressed bytes.Buffer
+	compressor, err := s.codec.codec.Compress(&compressed)
+	if err != nil {
+		return errorReader{fmt.Errorf("error compressing section: %w", err)}, 0
+	}
+
+	_, err = compressor.Write(data)
+	if err == nil {
+		err = compressor.Close()
+	}
+
+	if err != nil {
+		return errorReader{fmt.Errorf("error compressing section: %w", err)}, 0
+	}
+
+	header := sectionHeader(dataIndicator, section)
+	payload := data
+	if int64(compressed.Len()) < section.Length {
+		header = sectionHeader(compressedIndicator, section)
+
+		// byte + int64
+		var codec [1 + 8]byte
+		codec[0] = s.codec.id
+		binary.LittleEndian.PutUint64(codec[1:], uint64(compressed.Len()))
+		header = append(header, codec[:]...)
+		payload = compressed.Bytes()
+	}
+
+	trailer := checksumTrailer(crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, data))
+
+	length = int64(len(header)) + int64(len(payload)) + crc32.Size
+	reader = io.MultiReader(bytes.NewReader(header), bytes.NewReader(payload), bytes.NewReader(trailer))
+	return &digestingReader{reader: reader, data: data, offset: section.Offset, digest: &s.digest}, length
+}
+
+// sectionHeader returns the section type, offset and length that start the header of section
+func sectionHeader(indicator byte, section Section) []byte {
+	// char + int64 + int64
+	buf := make([]byte, 1+8+8)
+	buf[0] = indicator
+	binary.LittleEndian.PutUint64(buf[1:], uint64(section.Offset))
+	binary.LittleEndian.PutUint64(buf[1+8:], uint64(section.Length))
+	return buf
+}
+
+// checksumTrailer returns the CRC32C following a section
+func checksumTrailer(crc uint32) []byte {
+	buf := make([]byte, crc32.Size)
+	binary.LittleEndian.PutUint32(buf, crc)
+	return buf
+}
+
+// digestingReader adds the data of a section to the digest once the section is read, so predicting the size of a
+// stream without reading it doesn't hash any data
+type digestingReader struct {
+	reader io.Reader
+	data   []byte
+	offset int64
+	digest *fileDigest
+}
+
+func (d *digestingReader) Read(p []byte) (int, error) {
+	if d.data != nil {
+		d.digest.write(d.offset, d.data)
+		d.data = nil
+	}
+
+	return d.reader.Read(p)
+}
+
+func (s *sparsecatV1Stream) GetEndTagReader() (reader io.Reader, length int64) {
+	return &endTagReader{stream: s}, 1 + sha256.Size
+}
+
+// endTagReader calculates the digest once the end tag is read, so predicting the size of a stream doesn't hash
+// its holes
+type endTagReader struct {
+	stream *sparsecatV1Stream
+	reader io.Reader
+}
+
+func (e *endTagReader) Read(p []byte) (int, error) {
+	if e.reader == nil {
+		e.reader = bytes.NewReader(append([]byte{endIndicator}, e.stream.digest.sum(e.stream.size)...))
+	}
+
+	return e.reader.Read(p)
+}
+
+// start resets the stream state for a file of size bytes
+func (s *sparsecatV1Stream) start(size int64) {
+	s.size = size
+	s.offset = 0
+	s.digest.reset()
+}
+
+// fileDigest calculates the SHA-256 of the zero-filled file described by a stream. Data must be written in order,
+// the holes in between are hashed as zeros.
+type fileDigest struct {
+	hash hash.Hash
+	// position is the offset in the file up to which it has been hashed
+	position int64
+}
+
+// zeros is hashed repeatedly for the holes of a file
+var zeros [64 << 10]byte
+
+func (f *fileDigest) reset() {
+	f.hash.Reset()
+	f.position = 0
+}
+
+// write hashes data found at offset, after hashing the hole in front of it
+func (f *fileDigest) write(offset int64, data []byte) {
+	f.fill(offset)
+	f.hash.Write(data)
+	f.position += int64(len(data))
+}
+
+// fill hashes zeros up to offset
+func (f *fileDigest) fill(offset int64) {
+	for f.position < offset {
+		length := offset - f.position
+		if length > int64(len(zeros)) {
+			length = int64(len(zeros))
+		}
+
+		f.hash.Write(zeros[:length])
+		f.position += length
+	}
+}
+
+// sum returns the digest of a file of size bytes
+func (f *fileDigest) sum(size int64) []byte {
+	f.fill(size)
+	return f.hash.Sum(nil)
+}
+
+// checksumReader reads the data of a section and appends its CRC32C once all data has been read
+type checksumReader struct {
+	data    io.Reader
+	crc     hash.Hash32
+	digest  *fileDigest
+	offset  int64
+	trailer io.Reader
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	if c.trailer != nil {
+		return c.trailer.Read(p)
+	}
+
+	read, err := c.data.Read(p)
+	c.crc.Write(p[:read])
+	c.digest.write(c.offset, p[:read])
+	c.offset += int64(read)
+
+	if err == io.EOF {
+		c.trailer = bytes.NewReader(checksumTrailer(c.crc.Sum32()))
+		if read == 0 {
+			return c.trailer.Read(p)
+		}
+		return read, nil
+	}
+
+	return read, err
+}
+
+// verifyingReader reads the data of a section and verifies the CRC32C following it. For compressed sections
+// data is the decompressed data and compressed the raw section data.
+type verifyingReader struct {
+	stream       *sparsecatV1Stream
+	reader       io.Reader
+	data         io.Reader
+	compressed   io.Reader
+	decompressor io.ReadCloser
+	section      Section
+	read         int64
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	read, err := v.data.Read(p)
+	v.stream.sectionCRC.Write(p[:read])
+	v.stream.digest.write(v.section.Offset+v.read, p[:read])
+	v.read += int64(read)
+
+	if err == nil {
+		return read, nil
+	}
+
+	if err == io.EOF {
+		err = v.verify()
+	} else if v.decompressor != nil {
+		err = fmt.Errorf("error decompressing section: %w", err)
+	}
+
+	if v.decompressor != nil {
+		closeErr := v.decompressor.Close()
+		v.decompressor = nil
+
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	if err == nil {
+		err = io.EOF
+	}
+
+	return read, err
+}
+
+// verify checks the section once all of its data has been read
+func (v *verifyingReader) verify() error {
+	if v.read != v.section.Length {
+		return io.ErrUnexpectedEOF
+	}
+
+	if v.decompressor != nil {
+		// the compressed data must not contain more than the section
+		var extra [1]byte
+		_, err := io.ReadFull(v.decompressor, extra[:])
+		if err == nil {
+			return fmt.Errorf("compressed section at offset %d contains more than %d bytes", v.section.Offset, v.section.Length)
+		}
+
+		if err != io.EOF {
+			return fmt.Errorf("error decompressing section: %w", err)
+		}
+
+		// the decompressor doesn't necessarily consume all compressed data, such as the gzip footer
+		_, err = io.Copy(io.Discard, v.compressed)
+		if err != nil {
+			return fmt.Errorf("error reading compressed section: %w", err)
+		}
+	}
+
+	return v.stream.verifyChecksum(v.reader, v.section)
+}
+
+type errorReader struct {
+	err error
+}
+
+func (e errorReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
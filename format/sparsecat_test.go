@@ -0,0 +1,230 @@
+package format
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testSection is a section of a test stream together with its data
+type testSection struct {
+	Section
+	data []byte
+}
+
+// encodeStream writes a stream of f describing a file of size bytes containing sections
+func encodeStream(t *testing.T, f Format, size int64, sections []testSection) []byte {
+	t.Helper()
+
+	f = ForStream(f)
+
+	var stream bytes.Buffer
+	write := func(reader io.Reader, length int64) {
+		written, err := io.Copy(&stream, reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if written != length {
+			t.Fatalf("expected a reader of %d bytes, got %d", length, written)
+		}
+	}
+
+	write(f.GetFileSizeReader(uint64(size)))
+	for _, section := range sections {
+		write(f.GetSectionReader(bytes.NewReader(section.data), section.Section))
+	}
+	write(f.GetEndTagReader())
+
+	return stream.Bytes()
+}
+
+// decodeStream reads a stream of f and returns the file it describes
+func decodeStream(f Format, stream []byte) ([]byte, error) {
+	f = ForStream(f)
+	reader := bytes.NewReader(stream)
+
+	size, err := f.ReadFileSize(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	file := make([]byte, size)
+	for {
+		section, err := f.ReadSectionHeader(reader)
+		if errors.Is(err, io.EOF) {
+			return file, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if section.Offset < 0 || section.Length < 0 || section.Offset+section.Length > size {
+			return nil, errors.New("section doesn't fit in the file")
+		}
+
+		if section.Zero {
+			// a zero section can overwrite data of an earlier diff
+			copy(file[section.Offset:section.Offset+section.Length], make([]byte, section.Length))
+			continue
+		}
+
+		data, err := io.ReadAll(GetSectionDataReader(f, reader, section))
+		if err != nil {
+			return nil, err
+		}
+
+		copy(file[section.Offset:], data)
+	}
+}
+
+// testFile returns a file of size bytes with data at the given sections
+func testFile(size int64, sections []testSection) []byte {
+	file := make([]byte, size)
+	for _, section := range sections {
+		copy(file[section.Offset:], section.data)
+	}
+
+	return file
+}
+
+// sparsecatTestSections returns a data section followed by a zero section and another data section
+func sparsecatTestSections() []testSection {
+	return []testSection{
+		{Section: Section{Offset: 100, Length: 50}, data: bytes.Repeat([]byte{1}, 50)},
+		{Section: Section{Offset: 200, Length: 100, Zero: true}},
+		{Section: Section{Offset: 1000, Length: 24}, data: bytes.Repeat([]byte{2}, 24)},
+	}
+}
+
+func TestSparsecatV1RoundTrip(t *testing.T) {
+	const size = 100_000
+
+	sections := sparsecatTestSections()
+	stream := encodeStream(t, SparsecatV1, size, sections)
+
+	file, err := decodeStream(SparsecatV1, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testFile(size, sections)
+	if !bytes.Equal(file, expected) {
+		t.Error("decoded file doesn't match")
+	}
+
+	// the digest is that of the zero-filled file, like sha256sum of it
+	digest := sha256.Sum256(expected)
+	if !bytes.Equal(stream[len(stream)-sha256.Size:], digest[:]) {
+		t.Error("stream digest doesn't match the SHA-256 of the file")
+	}
+
+	// splitting the data differently doesn't change the digest
+	split := encodeStream(t, SparsecatV1, size, []testSection{
+		{Section: Section{Offset: 100, Length: 20}, data: bytes.Repeat([]byte{1}, 20)},
+		{Section: Section{Offset: 120, Length: 30}, data: bytes.Repeat([]byte{1}, 30)},
+		{Section: Section{Offset: 1000, Length: 24}, data: bytes.Repeat([]byte{2}, 24)},
+	})
+
+	if !bytes.Equal(split[len(split)-sha256.Size:], digest[:]) {
+		t.Error("stream digest depends on how the file is split into sections")
+	}
+}
+
+func TestSparsecatV1Corruption(t *testing.T) {
+	const size = 100_000
+
+	stream := encodeStream(t, SparsecatV1, size, sparsecatTestSections())
+
+	// the layout of the stream
+	const (
+		header      = len(sparsecatV1Header) + 1 + 8
+		firstData   = header
+		firstCRC    = firstData + 1 + 8 + 8 + 50
+		zeroSection = firstCRC + 4
+		secondData  = zeroSection + 1 + 8 + 8 + 4
+		endTag      = secondData + 1 + 8 + 8 + 24 + 4
+	)
+
+	if len(stream) != endTag+1+sha256.Size {
+		t.Fatalf("unexpected stream length %d", len(stream))
+	}
+
+	var checksumError *ChecksumError
+	var digestError *DigestError
+
+	tests := []struct {
+		name string
+		// mask is xor-ed with the byte at offset
+		offset int
+		mask   byte
+		check  func(err error) bool
+	}{
+		{name: "size", offset: header - 8, mask: 1, check: func(err error) bool { return errors.As(err, &digestError) }},
+		{name: "data section offset", offset: firstData + 1, mask: 1, check: func(err error) bool { return errors.As(err, &checksumError) }},
+		{name: "data section offset beyond the file", offset: firstData + 1 + 4, mask: 1, check: func(err error) bool { return err != nil }},
+		{name: "data", offset: firstData + 1 + 8 + 8 + 10, mask: 1, check: func(err error) bool { return errors.As(err, &checksumError) }},
+		{name: "checksum", offset: firstCRC, mask: 1, check: func(err error) bool { return errors.As(err, &checksumError) }},
+		{name: "zero section offset", offset: zeroSection + 1, mask: 1, check: func(err error) bool { return errors.As(err, &checksumError) }},
+		{name: "zero section length", offset: zeroSection + 1 + 8, mask: 1, check: func(err error) bool { return errors.As(err, &checksumError) }},
+		{name: "last section", offset: endTag - 5, mask: 1, check: func(err error) bool { return errors.As(err, &checksumError) }},
+		{name: "digest", offset: endTag + 1, mask: 1, check: func(err error) bool { return errors.As(err, &digestError) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			corrupt := append([]byte(nil), stream...)
+			corrupt[test.offset] ^= test.mask
+
+			_, err := decodeStream(SparsecatV1, corrupt)
+			if !test.check(err) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestSparsecatV1Truncated(t *testing.T) {
+	stream := encodeStream(t, SparsecatV1, 100_000, sparsecatTestSections())
+
+	for length := 0; length < len(stream); length++ {
+		_, err := decodeStream(SparsecatV1, stream[:length])
+		if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			t.Errorf("expected an unexpected EOF for a stream truncated to %d bytes, got %v", length, err)
+		}
+	}
+}
+
+func TestSparsecatV1Stateless(t *testing.T) {
+	_, err := SparsecatV1.ReadFileSize(bytes.NewReader(nil))
+	if err == nil {
+		t.Error("expected using the global format directly to fail")
+	}
+
+	// two streams of the same format don't influence each other
+	first, second := ForStream(SparsecatV1), ForStream(SparsecatV1)
+	_, _ = first.GetFileSizeReader(10)
+	_, _ = second.GetFileSizeReader(20)
+
+	reader, _ := first.GetSectionReader(bytes.NewReader([]byte{1}), Section{Offset: 0, Length: 1})
+	_, err = io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = second.GetSectionReader(bytes.NewReader([]byte{2}), Section{Offset: 5, Length: 1})
+
+	endTag, _ := first.GetEndTagReader()
+	tag, err := io.ReadAll(endTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(append([]byte{1}, make([]byte, 9)...))
+	if !bytes.Equal(tag[1:], digest[:]) {
+		t.Error("the digest of a stream is influenced by another stream")
+	}
+}
@@ -2,4 +2,7 @@ module github.com/svenwiltink/sparsecat
 
 go 1.17
 
-require golang.org/x/sys v0.0.0-20210601080250-7ecdf8ef093b
+require (
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
+)
@@ -0,0 +1,286 @@
+package sparsecat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	handshakeBanner = "SPARSECAT/1"
+	handshakeOK     = "OK"
+	handshakeError  = "ERROR"
+	handshakeDone   = "DONE"
+
+	maxHandshakeLine = 1024
+	// maxHandshakeLines limits the number of lines of a handshake, so unknown keys can't be sent forever
+	maxHandshakeLines = 64
+)
+
+// Handshake is exchanged before a stream is sent over a connection, so both sides agree on how to
+// interpret the stream.
+type Handshake struct {
+	// Format is the name of the wire format of the stream. The receiving side may leave it empty to accept
+	// the format of the sending side.
+	Format string
+	// Offset is the offset the receiving side wants to resume the transfer from. The sending side starts
+	// encoding at this offset when it supports resuming.
+	Offset int64
+	// Streams is the number of streams the sending side uses to transfer a single file in parallel. Zero means
+	// the file is sent as a single stream.
+	Streams int
+	// Stream is the index of this stream when the file is sent in parallel.
+	Stream int
+	// BlockSize is the size of the blocks compared by a delta transfer, see SendDelta. Zero means the entire file is
+	// sent. The receiving side sets it to any positive value to accept delta transfers, the block size of the
+	// sending side is used.
+	BlockSize int64
+}
+
+// streamCount returns the number of streams of the transfer the handshake belongs to
+func (h Handshake) streamCount() int {
+	if h.Streams < 1 {
+		return 1
+	}
+
+	return h.Streams
+}
+
+// HandshakeError is returned when the other side of a connection rejected the handshake or failed
+// to write the stream.
+type HandshakeError struct {
+	Message string
+}
+
+func (h *HandshakeError) Error() string {
+	return "remote error: " + h.Message
+}
+
+// Send performs the handshake over conn and sends stream, usually an Encoder, to the receiving side. It returns
+// once the receiving side has confirmed the stream has been written. The handshake of the receiving side is returned.
+func Send(conn io.ReadWriter, handshake Handshake, stream io.Reader) (Handshake, error) {
+	remote, err := SendHandshake(conn, handshake)
+	if err != nil {
+		return remote, err
+	}
+
+	return remote, SendStream(conn, stream)
+}
+
+// SendStream sends stream over conn after the handshake has been performed using SendHandshake. It returns
+// once the receiving side has confirmed the stream has been written.
+func SendStream(conn io.ReadWriter, stream io.Reader) error {
+	_, err := io.Copy(conn, stream)
+	if err != nil {
+		// the receiving side might have aborted the transfer, prefer its explanation
+		var handshakeErr *HandshakeError
+		if statusErr := readStatus(conn); errors.As(statusErr, &handshakeErr) {
+			return statusErr
+		}
+		return fmt.Errorf("error sending stream: %w", err)
+	}
+
+	return readStatus(conn)
+}
+
+// Receive performs the handshake over conn and calls write with the handshake of the sending side and the incoming
+// stream. The result of write is reported back to the sending side.
+func Receive(conn io.ReadWriter, handshake Handshake, write func(remote Handshake, stream io.Reader) error) (Handshake, error) {
+	remote, err := ReceiveHandshake(conn, handshake)
+	if err != nil {
+		return remote, err
+	}
+
+	return remote, receiveStream(conn, remote, write)
+}
+
+// receiveStream calls write with the stream following the handshake and reports the result to the sending side
+func receiveStream(conn io.ReadWriter, remote Handshake, write func(remote Handshake, stream io.Reader) error) error {
+	err := write(remote, conn)
+	if err != nil {
+		_ = writeError(conn, err)
+		return err
+	}
+
+	return writeLines(conn, handshakeDone)
+}
+
+// SendHandshake sends the handshake of the sending side and waits for the receiving side to accept it.
+func SendHandshake(conn io.ReadWriter, handshake Handshake) (Handshake, error) {
+	err := writeLines(conn, append([]string{handshakeBanner}, handshake.lines()...)...)
+	if err != nil {
+		return Handshake{}, fmt.Errorf("error sending handshake: %w", err)
+	}
+
+	err = readStatus(conn)
+	if err != nil {
+		return Handshake{}, err
+	}
+
+	return readHandshake(conn)
+}
+
+// ReceiveHandshake reads the handshake of the sending side and accepts it when it is compatible with handshake.
+// The handshake sent back contains the negotiated values.
+func ReceiveHandshake(conn io.ReadWriter, handshake Handshake) (Handshake, error) {
+	banner, err := readLine(conn)
+	if err != nil {
+		return Handshake{}, fmt.Errorf("error reading handshake: %w", err)
+	}
+
+	if banner != handshakeBanner {
+		return Handshake{}, fmt.Errorf("invalid handshake banner %q", banner)
+	}
+
+	remote, err := readHandshake(conn)
+	if err != nil {
+		return remote, err
+	}
+
+	if handshake.Format == "" {
+		handshake.Format = remote.Format
+	}
+
+	if handshake.Format != remote.Format {
+		err = fmt.Errorf("format mismatch. Expected %s but got %s", handshake.Format, remote.Format)
+		_ = writeError(conn, err)
+		return remote, err
+	}
+
+	// both sides have to take part in a delta transfer, otherwise they would wait for each other
+	if (handshake.BlockSize > 0) != (remote.BlockSize > 0) {
+		err = errors.New("delta transfers must be enabled on both sides")
+		_ = writeError(conn, err)
+		return remote, err
+	}
+
+	if handshake.BlockSize > 0 {
+		handshake.BlockSize = remote.BlockSize
+	}
+
+	err = writeLines(conn, append([]string{handshakeOK}, handshake.lines()...)...)
+	if err != nil {
+		return remote, fmt.Errorf("error accepting handshake: %w", err)
+	}
+
+	return remote, nil
+}
+
+// lines encodes the handshake as key value pairs followed by an empty line
+func (h Handshake) lines() []string {
+	lines := []string{
+		"format " + h.Format,
+		"offset " + strconv.FormatInt(h.Offset, 10),
+	}
+
+	if h.Streams > 1 {
+		lines = append(lines,
+			"streams "+strconv.Itoa(h.Streams),
+			"stream "+strconv.Itoa(h.Stream),
+		)
+	}
+
+	if h.BlockSize > 0 {
+		lines = append(lines, "block-size "+strconv.FormatInt(h.BlockSize, 10))
+	}
+
+	return append(lines, "")
+}
+
+func readHandshake(reader io.Reader) (Handshake, error) {
+	var handshake Handshake
+	for lines := 0; ; lines++ {
+		if lines == maxHandshakeLines {
+			return handshake, errors.New("error reading handshake: too many lines")
+		}
+
+		line, err := readLine(reader)
+		if err != nil {
+			return handshake, fmt.Errorf("error reading handshake: %w", err)
+		}
+
+		if line == "" {
+			return handshake, nil
+		}
+
+		key, value := line, ""
+		if index := strings.IndexByte(line, ' '); index >= 0 {
+			key, value = line[:index], line[index+1:]
+		}
+
+		// unknown keys are ignored so new ones can be added later
+		switch key {
+		case "format":
+			handshake.Format = value
+		case "offset":
+			handshake.Offset, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return handshake, fmt.Errorf("invalid offset %q: %w", value, err)
+			}
+		case "streams":
+			handshake.Streams, err = strconv.Atoi(value)
+			if err != nil {
+				return handshake, fmt.Errorf("invalid number of streams %q: %w", value, err)
+			}
+		case "stream":
+			handshake.Stream, err = strconv.Atoi(value)
+			if err != nil {
+				return handshake, fmt.Errorf("invalid stream %q: %w", value, err)
+			}
+		case "block-size":
+			handshake.BlockSize, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return handshake, fmt.Errorf("invalid block size %q: %w", value, err)
+			}
+		}
+	}
+}
+
+// readStatus reads the status line sent by the receiving side
+func readStatus(reader io.Reader) error {
+	line, err := readLine(reader)
+	if err != nil {
+		return fmt.Errorf("error reading status: %w", err)
+	}
+
+	if line == handshakeOK || line == handshakeDone {
+		return nil
+	}
+
+	if strings.HasPrefix(line, handshakeError+" ") {
+		return &HandshakeError{Message: strings.TrimPrefix(line, handshakeError+" ")}
+	}
+
+	return fmt.Errorf("invalid status %q", line)
+}
+
+func writeLines(writer io.Writer, lines ...string) error {
+	_, err := io.WriteString(writer, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+func writeError(writer io.Writer, err error) error {
+	return writeLines(writer, handshakeError+" "+strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+// readLine reads a single line a byte at a time, so no data following the line is consumed
+func readLine(reader io.Reader) (string, error) {
+	var line []byte
+	var buf [1]byte
+	for len(line) < maxHandshakeLine {
+		_, err := io.ReadFull(reader, buf[:])
+		if err != nil {
+			return "", err
+		}
+
+		if buf[0] == '\n' {
+			return string(line), nil
+		}
+
+		line = append(line, buf[0])
+	}
+
+	return "", errors.New("handshake line too long")
+}
@@ -0,0 +1,61 @@
+package sparsecat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected Handshake
+		fails    bool
+	}{
+		{
+			name:     "known keys",
+			input:    "format sparsecat-v1\noffset 4096\nstreams 2\nstream 1\nblock-size 65536\n\n",
+			expected: Handshake{Format: "sparsecat-v1", Offset: 4096, Streams: 2, Stream: 1, BlockSize: 65536},
+		},
+		{
+			name:     "unknown keys",
+			input:    "format sparsecat-v1\nsomething new\n\n",
+			expected: Handshake{Format: "sparsecat-v1"},
+		},
+		{
+			name:  "line too long",
+			input: "format " + strings.Repeat("a", maxHandshakeLine) + "\n\n",
+			fails: true,
+		},
+		{
+			name:  "too many lines",
+			input: strings.Repeat("unknown key\n", maxHandshakeLines) + "\n",
+			fails: true,
+		},
+		{
+			name:  "unterminated",
+			input: "format sparsecat-v1\n",
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handshake, err := readHandshake(strings.NewReader(test.input))
+			if test.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if handshake != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, handshake)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package sparsecat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrPunchHoleUnsupported is returned by PunchHole when the filesystem or platform can't punch holes.
+var ErrPunchHoleUnsupported = errors.New("punching holes is not supported")
+
+// HoleMode determines what the Decoder does with the holes of a file when writing it to a target that might
+// already contain data.
+type HoleMode int
+
+const (
+	// HolesKeep leaves the target untouched where the file has holes. This is only correct when the target
+	// is new or has been truncated to zero.
+	HolesKeep HoleMode = iota
+	// HolesPunch deallocates the holes in the target, keeping it sparse. Zeros are written instead when the
+	// target doesn't support punching holes.
+	HolesPunch
+	// HolesZero writes zeros to the holes in the target. Block devices are zeroed using BLKZEROOUT, which lets
+	// the device offload the work.
+	HolesZero
+	// HolesDiscard discards the holes of a block device using BLKDISCARD. Only use this when the device guarantees
+	// discarded blocks read as zeros. For other targets it behaves like HolesPunch.
+	HolesDiscard
+)
+
+// HolePuncher can be implemented by the target of a Decoder to deallocate the holes of a file. PunchHole returns
+// ErrPunchHoleUnsupported when it isn't possible, in which case zeros are written instead.
+type HolePuncher interface {
+	PunchHole(offset int64, length int64) error
+}
+
+// zeroBufferSize is the size of the buffer used to write zeros to holes
+const zeroBufferSize = 1024 * 1024
+
+// holeClearer makes the holes of a target read as zeros according to a HoleMode
+type holeClearer struct {
+	target io.WriterAt
+	mode   HoleMode
+
+	// blockDevice is set when the target is a block device, which is cleared using ioctls
+	blockDevice *os.File
+	sectorSize  int64
+}
+
+// clear makes the range of the target starting at offset read as zeros
+func (h holeClearer) clear(offset int64, length int64) error {
+	if h.mode == HolesKeep || length <= 0 {
+		return nil
+	}
+
+	if h.blockDevice != nil {
+		return h.clearBlockDevice(offset, length)
+	}
+
+	if h.mode == HolesPunch || h.mode == HolesDiscard {
+		var err error
+		switch target := h.target.(type) {
+		case *os.File:
+			err = PunchHole(target, offset, length)
+		case HolePuncher:
+			err = target.PunchHole(offset, length)
+		default:
+			err = ErrPunchHoleUnsupported
+		}
+
+		if !errors.Is(err, ErrPunchHoleUnsupported) {
+			return err
+		}
+	}
+
+	return writeZeros(h.target, offset, length)
+}
+
+// clearBlockDevice clears a range of a block device. The ioctls only accept whole sectors, so the unaligned
+// start and end of the range are zeroed by writing to them.
+func (h holeClearer) clearBlockDevice(offset int64, length int64) error {
+	end := offset + length
+	alignedStart := (offset + h.sectorSize - 1) / h.sectorSize * h.sectorSize
+	alignedEnd := end / h.sectorSize * h.sectorSize
+
+	if alignedStart >= alignedEnd {
+		return writeZeros(h.target, offset, length)
+	}
+
+	var err error
+	switch h.mode {
+	case HolesDiscard:
+		err = discardBlockDevice(h.blockDevice, alignedStart, alignedEnd-alignedStart)
+	case HolesPunch:
+		err = PunchHole(h.blockDevice, alignedStart, alignedEnd-alignedStart)
+	default:
+		err = zeroOutBlockDevice(h.blockDevice, alignedStart, alignedEnd-alignedStart)
+	}
+
+	if errors.Is(err, ErrPunchHoleUnsupported) {
+		err = writeZeros(h.target, alignedStart, alignedEnd-alignedStart)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = writeZeros(h.target, offset, alignedStart-offset)
+	if err != nil {
+		return err
+	}
+
+	return writeZeros(h.target, alignedEnd, end-alignedEnd)
+}
+
+// writeZeros writes length zeros to target starting at offset
+func writeZeros(target io.WriterAt, offset int64, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+
+	size := int64(zeroBufferSize)
+	if length < size {
+		size = length
+	}
+
+	zeros := make([]byte, size)
+	for length > 0 {
+		chunk := zeros
+		if int64(len(chunk)) > length {
+			chunk = chunk[:length]
+		}
+
+		written, err := target.WriteAt(chunk, offset)
+		if err != nil {
+			return fmt.Errorf("error writing zeros: %w", err)
+		}
+
+		offset += int64(written)
+		length -= int64(written)
+	}
+
+	return nil
+}
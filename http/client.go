@@ -0,0 +1,112 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/svenwiltink/sparsecat"
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// Client uploads and downloads sparse files to and from a Handler.
+type Client struct {
+	HTTPClient *http.Client
+	// Format is the wire format used for uploads and requested for downloads
+	Format string
+}
+
+func NewClient() *Client {
+	return &Client{HTTPClient: http.DefaultClient, Format: DefaultFormat}
+}
+
+// StatusError is returned when the server responds with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", s.StatusCode, s.Message)
+}
+
+// Upload sends source to url as a sparse stream.
+func (c *Client) Upload(url string, source *os.File) error {
+	f, exists := format.GetByName(c.Format)
+	if !exists {
+		return fmt.Errorf("format %s doesn't exist", c.Format)
+	}
+
+	encoder := sparsecat.NewEncoder(source)
+	encoder.Format = f
+
+	request, err := http.NewRequest(http.MethodPut, url, encoder)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set(FormatHeader, c.Format)
+	request.Header.Set("Content-Type", mime.FormatMediaType(MediaType, map[string]string{"format": c.Format}))
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error uploading file: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+		return statusError(response)
+	}
+
+	return nil
+}
+
+// Download retrieves the sparse stream at url and writes it to target, preserving its sparseness.
+func (c *Client) Download(url string, target *os.File) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set(FormatHeader, c.Format)
+	request.Header.Set("Accept", mime.FormatMediaType(MediaType, map[string]string{"format": c.Format}))
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error downloading file: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return statusError(response)
+	}
+
+	// the server has the final say in the format of the stream
+	formatName := response.Header.Get(FormatHeader)
+	if formatName == "" {
+		formatName = c.Format
+	}
+
+	f, exists := format.GetByName(formatName)
+	if !exists {
+		return fmt.Errorf("server responded with unknown format %s", formatName)
+	}
+
+	decoder := sparsecat.NewDecoder(response.Body)
+	decoder.Format = f
+
+	_, err = io.Copy(target, decoder)
+	if err != nil {
+		return fmt.Errorf("error decoding stream: %w", err)
+	}
+
+	return nil
+}
+
+func statusError(response *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	return &StatusError{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+}
@@ -0,0 +1,266 @@
+// Package http transfers sparse files over HTTP. The Handler accepts sparse uploads into a directory and serves
+// the files in it as sparse streams, the Client uploads and downloads files to and from such a Handler.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/svenwiltink/sparsecat"
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+const (
+	// FormatHeader contains the wire format of a sparse stream.
+	FormatHeader = "Sparsecat-Format"
+	// MediaType is the content type of sparse streams. The format can be passed as parameter, for example
+	// application/x-sparsecat; format=rbd-diff-v2.
+	MediaType = "application/x-sparsecat"
+
+	DefaultFormat = "rbd-diff-v1"
+
+	// DefaultMaxFileSize is the largest file a Handler created by NewHandler accepts
+	DefaultMaxFileSize = 1 << 40 // 1TiB
+)
+
+// Handler accepts sparse uploads using PUT or POST requests and serves files as sparse streams on GET requests.
+// The request path is the name of the file in Directory, paths containing a directory are rejected. The format of
+// a stream is taken from the Sparsecat-Format header or the format parameter of the Content-Type or Accept header.
+type Handler struct {
+	Directory     string
+	DefaultFormat string
+	// MaxFileSize rejects uploads declaring a larger file size in their header, before any of it is written. Zero
+	// means there is no limit.
+	MaxFileSize int64
+	// ErrorLog receives errors that can't be reported to the client. It defaults to no logging.
+	ErrorLog func(err error)
+}
+
+func NewHandler(directory string) *Handler {
+	return &Handler{Directory: directory, DefaultFormat: DefaultFormat, MaxFileSize: DefaultMaxFileSize}
+}
+
+func (h *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	name, err := fileName(request.URL.Path)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodPut, http.MethodPost:
+		h.upload(writer, request, name)
+	case http.MethodGet:
+		h.download(writer, request, name)
+	default:
+		writer.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) upload(writer http.ResponseWriter, request *http.Request, name string) {
+	formatName, f, err := h.requestFormat(request.Header.Get(FormatHeader), request.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// write to a temporary file first so a failed upload doesn't replace an existing file
+	target, err := os.CreateTemp(h.Directory, "."+name+".*.upload")
+	if err != nil {
+		h.internalError(writer, fmt.Errorf("error creating file: %w", err))
+		return
+	}
+	defer os.Remove(target.Name())
+	defer target.Close()
+
+	decoder := sparsecat.NewDecoder(request.Body)
+	decoder.Format = f
+	decoder.MaxFileSize = h.MaxFileSize
+
+	status, err := h.decode(decoder, target)
+	if status == http.StatusInternalServerError {
+		h.internalError(writer, fmt.Errorf("error writing %s: %w", name, err))
+		return
+	}
+
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("error decoding %s stream: %s", formatName, err), status)
+		return
+	}
+
+	// temporary files are only readable by their owner
+	err = target.Chmod(0644)
+	if err == nil {
+		err = target.Close()
+	}
+
+	if err != nil {
+		h.internalError(writer, fmt.Errorf("error closing file: %w", err))
+		return
+	}
+
+	err = os.Rename(target.Name(), filepath.Join(h.Directory, name))
+	if err != nil {
+		h.internalError(writer, fmt.Errorf("error storing file: %w", err))
+		return
+	}
+
+	writer.WriteHeader(http.StatusCreated)
+}
+
+// decode writes the upload to target. The returned status tells errors in the stream apart from errors writing
+// the file, such as a full disk.
+func (h *Handler) decode(decoder *sparsecat.Decoder, target *os.File) (int, error) {
+	recorder := &uploadTarget{file: target}
+
+	_, err := io.Copy(recorder, decoder)
+	switch {
+	case err == nil:
+		return http.StatusCreated, nil
+	case recorder.err != nil:
+		return http.StatusInternalServerError, recorder.err
+	case errors.Is(err, sparsecat.ErrFileTooLarge):
+		return http.StatusRequestEntityTooLarge, err
+	}
+
+	return http.StatusBadRequest, err
+}
+
+// uploadTarget records the errors writing an uploaded file. It implements sparsecat.Truncater, so the Decoder
+// still only writes the data of the file.
+type uploadTarget struct {
+	file *os.File
+	err  error
+}
+
+func (u *uploadTarget) Write(p []byte) (int, error) {
+	written, err := u.file.Write(p)
+	return written, u.record(err)
+}
+
+func (u *uploadTarget) WriteAt(p []byte, offset int64) (int, error) {
+	written, err := u.file.WriteAt(p, offset)
+	return written, u.record(err)
+}
+
+func (u *uploadTarget) Truncate(size int64) error {
+	return u.record(sparsecat.SparseTruncate(u.file, size))
+}
+
+func (u *uploadTarget) record(err error) error {
+	if err != nil && u.err == nil {
+		u.err = err
+	}
+	return err
+}
+
+func (h *Handler) download(writer http.ResponseWriter, request *http.Request, name string) {
+	formatName, f, err := h.requestFormat(request.Header.Get(FormatHeader), request.Header.Get("Accept"))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	source, err := os.Open(filepath.Join(h.Directory, name))
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(writer, request)
+		return
+	}
+
+	if err != nil {
+		h.internalError(writer, fmt.Errorf("error opening file: %w", err))
+		return
+	}
+	defer source.Close()
+
+	// directories and devices aren't files that can be downloaded
+	info, err := source.Stat()
+	if err != nil {
+		h.internalError(writer, fmt.Errorf("error running stat: %w", err))
+		return
+	}
+
+	if !info.Mode().IsRegular() {
+		http.NotFound(writer, request)
+		return
+	}
+
+	encoder := sparsecat.NewEncoder(source)
+	encoder.Format = f
+
+	writer.Header().Set(FormatHeader, formatName)
+	writer.Header().Set("Content-Type", mime.FormatMediaType(MediaType, map[string]string{"format": formatName}))
+
+	// the status has already been sent once copying starts, so errors can only be logged. The client notices
+	// the stream is incomplete as the end tag is missing
+	_, err = io.Copy(writer, encoder)
+	if err != nil {
+		h.logError(fmt.Errorf("error sending %s: %w", name, err))
+	}
+}
+
+// requestFormat determines the format using the format header, falling back to the format parameter
+// of the media type and the default format
+func (h *Handler) requestFormat(header string, mediaTypes string) (string, format.Format, error) {
+	formatName := header
+	if formatName == "" {
+		formatName = formatFromMediaTypes(mediaTypes)
+	}
+
+	if formatName == "" {
+		formatName = h.DefaultFormat
+	}
+
+	f, exists := format.GetByName(formatName)
+	if !exists {
+		return "", nil, fmt.Errorf("format %s doesn't exist", formatName)
+	}
+
+	return formatName, f, nil
+}
+
+func (h *Handler) internalError(writer http.ResponseWriter, err error) {
+	h.logError(err)
+	http.Error(writer, "internal server error", http.StatusInternalServerError)
+}
+
+func (h *Handler) logError(err error) {
+	if h.ErrorLog != nil {
+		h.ErrorLog(err)
+	}
+}
+
+// formatFromMediaTypes returns the format parameter of the first sparsecat media type in a Content-Type or
+// Accept header
+func formatFromMediaTypes(header string) string {
+	for _, mediaType := range strings.Split(header, ",") {
+		parsed, params, err := mime.ParseMediaType(mediaType)
+		if err == nil && parsed == MediaType && params["format"] != "" {
+			return params["format"]
+		}
+	}
+	return ""
+}
+
+// fileName returns the file name of a request path. Only plain file names are accepted to prevent
+// access outside of the directory. Paths containing a directory are rejected instead of storing different paths
+// under the same name, hidden names are used for uploads in progress.
+func fileName(requestPath string) (string, error) {
+	name := strings.TrimPrefix(requestPath, "/")
+	if strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("invalid file name %q, directories aren't supported", name)
+	}
+
+	if name == "" || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+
+	return name, nil
+}
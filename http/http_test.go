@@ -0,0 +1,357 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat"
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// testFile creates a sparse file of 1MiB with a few blocks of data
+func testFile(t *testing.T, directory string, name string) *os.File {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(directory, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = file.Close() })
+
+	err = file.Truncate(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, offset := range []int64{0, 64 << 10, 300 << 10, 1<<20 - 4096} {
+		_, err = file.WriteAt(bytes.Repeat([]byte{byte(i + 1)}, 4096), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return file
+}
+
+// encodeFile returns the stream of file in the named format
+func encodeFile(t *testing.T, file *os.File, formatName string) []byte {
+	t.Helper()
+
+	f, exists := format.GetByName(formatName)
+	if !exists {
+		t.Fatalf("format %s doesn't exist", formatName)
+	}
+
+	encoder := sparsecat.NewEncoder(file)
+	encoder.Format = f
+
+	stream, err := io.ReadAll(encoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stream
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestHandlerFileNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected int
+	}{
+		{name: "plain name", path: "/image.raw", expected: http.StatusCreated},
+		{name: "parent directory", path: "/../x", expected: http.StatusBadRequest},
+		{name: "parent directory itself", path: "/..", expected: http.StatusBadRequest},
+		{name: "subdirectory", path: "/a/b", expected: http.StatusBadRequest},
+		{name: "escaped slash", path: "/a%2Fb", expected: http.StatusBadRequest},
+		{name: "absolute path", path: "//tmp/x", expected: http.StatusBadRequest},
+		{name: "backslash", path: `/a\b`, expected: http.StatusBadRequest},
+		{name: "hidden file", path: "/.image.raw", expected: http.StatusBadRequest},
+		{name: "no name", path: "/", expected: http.StatusBadRequest},
+	}
+
+	source := testFile(t, t.TempDir(), "source")
+	stream := encodeFile(t, source, DefaultFormat)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the directory is nested so files written outside of it can be detected
+			root := t.TempDir()
+			directory := filepath.Join(root, "images")
+			err := os.Mkdir(directory, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, method := range []string{http.MethodPut, http.MethodGet} {
+				var body io.Reader
+				if method == http.MethodPut {
+					body = bytes.NewReader(stream)
+				}
+
+				recorder := httptest.NewRecorder()
+				NewHandler(directory).ServeHTTP(recorder, httptest.NewRequest(method, test.path, body))
+
+				expected := test.expected
+				if method == http.MethodGet && expected == http.StatusCreated {
+					expected = http.StatusOK
+				}
+
+				if recorder.Code != expected {
+					t.Errorf("%s: expected status %d, got %d: %s", method, expected, recorder.Code, recorder.Body)
+				}
+			}
+
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries) != 1 {
+				t.Errorf("expected only the images directory, got %d entries", len(entries))
+			}
+
+			entries, err = os.ReadDir(directory)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.expected != http.StatusCreated && len(entries) != 0 {
+				t.Errorf("expected no files to be stored, got %s", entries[0].Name())
+			}
+		})
+	}
+}
+
+func TestHandlerUploadErrors(t *testing.T) {
+	directory := t.TempDir()
+	source := testFile(t, t.TempDir(), "source")
+	stream := encodeFile(t, source, DefaultFormat)
+
+	truncated := stream[:len(stream)/2]
+	corrupted := append([]byte{}, stream...)
+	corrupted[0] = 'x'
+
+	tests := []struct {
+		name        string
+		maxFileSize int64
+		stream      []byte
+		expected    int
+	}{
+		{name: "below the maximum file size", maxFileSize: 1 << 20, stream: stream, expected: http.StatusCreated},
+		{name: "above the maximum file size", maxFileSize: 1<<20 - 1, stream: stream, expected: http.StatusRequestEntityTooLarge},
+		{name: "truncated stream", stream: truncated, expected: http.StatusBadRequest},
+		{name: "corrupted stream", stream: corrupted, expected: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := NewHandler(directory)
+			handler.MaxFileSize = test.maxFileSize
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/image.raw", bytes.NewReader(test.stream)))
+
+			if recorder.Code != test.expected {
+				t.Errorf("expected status %d, got %d: %s", test.expected, recorder.Code, recorder.Body)
+			}
+		})
+	}
+
+	// a failed upload leaves the file of the first upload alone
+	if !bytes.Equal(readFile(t, filepath.Join(directory, "image.raw")), readFile(t, source.Name())) {
+		t.Error("stored file doesn't match the source")
+	}
+}
+
+func TestHandlerTargetError(t *testing.T) {
+	source := testFile(t, t.TempDir(), "source")
+	stream := encodeFile(t, source, DefaultFormat)
+
+	// writing to a file opened for reading fails like writing to a full disk would
+	target, err := os.Open(testFile(t, t.TempDir(), "target").Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	f, _ := format.GetByName(DefaultFormat)
+	decoder := sparsecat.NewDecoder(bytes.NewReader(stream))
+	decoder.Format = f
+
+	status, err := NewHandler(t.TempDir()).decode(decoder, target)
+	if status != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d: %v", http.StatusInternalServerError, status, err)
+	}
+}
+
+func TestHandlerFormats(t *testing.T) {
+	mediaType := func(formatName string) string {
+		return mime.FormatMediaType(MediaType, map[string]string{"format": formatName})
+	}
+
+	tests := []struct {
+		name         string
+		formatHeader string
+		mediaType    string
+		// format is the format of the stream, both uploaded and expected from a download
+		format         string
+		uploadStatus   int
+		downloadStatus int
+	}{
+		{name: "default format", format: DefaultFormat, uploadStatus: http.StatusCreated, downloadStatus: http.StatusOK},
+		{name: "format header", formatHeader: "sparsecat-v1", format: "sparsecat-v1", uploadStatus: http.StatusCreated, downloadStatus: http.StatusOK},
+		{name: "media type", mediaType: mediaType("rbd-diff-v2"), format: "rbd-diff-v2", uploadStatus: http.StatusCreated, downloadStatus: http.StatusOK},
+		{name: "media type in list", mediaType: "text/plain, " + mediaType("sparsecat-v1"), format: "sparsecat-v1", uploadStatus: http.StatusCreated, downloadStatus: http.StatusOK},
+		{name: "header before media type", formatHeader: "rbd-diff-v2", mediaType: mediaType("sparsecat-v1"), format: "rbd-diff-v2", uploadStatus: http.StatusCreated, downloadStatus: http.StatusOK},
+		{name: "media type without format", mediaType: MediaType, format: DefaultFormat, uploadStatus: http.StatusCreated, downloadStatus: http.StatusOK},
+		{name: "unknown format", formatHeader: "unknown", format: DefaultFormat, uploadStatus: http.StatusBadRequest, downloadStatus: http.StatusNotAcceptable},
+		{name: "stream in a different format", formatHeader: "sparsecat-v1", format: "rbd-diff-v2", uploadStatus: http.StatusBadRequest, downloadStatus: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			handler := NewHandler(directory)
+			source := testFile(t, directory, "source")
+			stream := encodeFile(t, source, test.format)
+
+			request := httptest.NewRequest(http.MethodPut, "/image.raw", bytes.NewReader(stream))
+			request.Header.Set(FormatHeader, test.formatHeader)
+			request.Header.Set("Content-Type", test.mediaType)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.uploadStatus {
+				t.Fatalf("expected upload status %d, got %d: %s", test.uploadStatus, recorder.Code, recorder.Body)
+			}
+
+			// downloads use the same headers, so the stream matches the upload
+			request = httptest.NewRequest(http.MethodGet, "/source", nil)
+			request.Header.Set(FormatHeader, test.formatHeader)
+			request.Header.Set("Accept", test.mediaType)
+
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.downloadStatus {
+				t.Fatalf("expected download status %d, got %d: %s", test.downloadStatus, recorder.Code, recorder.Body)
+			}
+
+			if recorder.Code != http.StatusOK {
+				return
+			}
+
+			formatName := recorder.Header().Get(FormatHeader)
+			expectedFormat := test.formatHeader
+			if expectedFormat == "" {
+				expectedFormat = test.format
+			}
+
+			if formatName != expectedFormat {
+				t.Errorf("expected format %s, got %s", expectedFormat, formatName)
+			}
+
+			if recorder.Header().Get("Content-Type") != mediaType(formatName) {
+				t.Errorf("expected content type %s, got %s", mediaType(formatName), recorder.Header().Get("Content-Type"))
+			}
+
+			if !bytes.Equal(recorder.Body.Bytes(), encodeFile(t, source, formatName)) {
+				t.Errorf("downloaded stream doesn't match a %s stream of the file", formatName)
+			}
+		})
+	}
+}
+
+func TestHandlerDownloadNotFound(t *testing.T) {
+	directory := t.TempDir()
+	err := os.Mkdir(filepath.Join(directory, "subdirectory"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"missing", "subdirectory"} {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			NewHandler(directory).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("expected status %d, got %d: %s", http.StatusNotFound, recorder.Code, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	source := testFile(t, t.TempDir(), "source")
+	expected := readFile(t, source.Name())
+
+	directory := t.TempDir()
+	server := httptest.NewServer(NewHandler(directory))
+	defer server.Close()
+
+	for _, formatName := range []string{"rbd-diff-v1", "rbd-diff-v2", "sparsecat-v1"} {
+		t.Run(formatName, func(t *testing.T) {
+			client := NewClient()
+			client.Format = formatName
+
+			_, err := source.Seek(0, io.SeekStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = client.Upload(server.URL+"/"+formatName, source)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(readFile(t, filepath.Join(directory, formatName)), expected) {
+				t.Error("uploaded file doesn't match the source")
+			}
+
+			target, err := os.Create(filepath.Join(t.TempDir(), "target"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+
+			err = client.Download(server.URL+"/"+formatName, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(readFile(t, target.Name()), expected) {
+				t.Error("downloaded file doesn't match the source")
+			}
+		})
+	}
+
+	target, err := os.Create(filepath.Join(t.TempDir(), "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	err = NewClient().Download(server.URL+"/missing", target)
+	if statusError, ok := err.(*StatusError); !ok || statusError.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a status error with status %d, got %v", http.StatusNotFound, err)
+	}
+}
@@ -0,0 +1,76 @@
+package sparsecat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// StreamInfo describes the content of a sparsecat stream.
+type StreamInfo struct {
+	format.Header
+	// DataBytes is the amount of data contained in the sections of the stream.
+	DataBytes int64 `json:"dataBytes"`
+	// ZeroBytes is the amount of bytes covered by zero sections.
+	ZeroBytes int64 `json:"zeroBytes"`
+	// HoleBytes is the part of the file not covered by any section.
+	HoleBytes int64 `json:"holeBytes"`
+	// LargestSection is the length of the largest data section.
+	LargestSection int64 `json:"largestSection"`
+	// Sections lists the data and zero sections in the order they appear in the stream.
+	Sections []format.Section `json:"sections"`
+}
+
+// Inspect reads a stream of format f up to the end tag and describes its content. The data of the sections is
+// read and discarded, so any checksums used by the format are verified.
+func Inspect(stream io.Reader, f format.Format) (*StreamInfo, error) {
+	f = format.ForStream(f)
+
+	header, err := format.ReadHeader(f, stream)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file size: %w", err)
+	}
+
+	info := &StreamInfo{Header: header, Sections: []format.Section{}}
+	for {
+		section, err := f.ReadSectionHeader(stream)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return info, err
+		}
+
+		if section.Zero {
+			info.Sections = append(info.Sections, section)
+			info.ZeroBytes += section.Length
+			continue
+		}
+
+		copied, err := io.Copy(io.Discard, format.GetSectionDataReader(f, stream, section))
+		if err != nil {
+			return info, fmt.Errorf("error reading data of section at offset %d: %w", section.Offset, err)
+		}
+
+		if copied != section.Length {
+			return info, fmt.Errorf("read size doesn't equal section size. %d vs %d. %w", copied, section.Length, io.ErrUnexpectedEOF)
+		}
+
+		info.Sections = append(info.Sections, section)
+		info.DataBytes += section.Length
+		if section.Length > info.LargestSection {
+			info.LargestSection = section.Length
+		}
+	}
+
+	// streams containing several diffs end at the snapshot of the last one
+	if chain, ok := f.(format.DiffChainFormat); ok {
+		info.ToSnapshot = chain.LastHeader().ToSnapshot
+	}
+
+	info.HoleBytes = info.Size - info.DataBytes - info.ZeroBytes
+	return info, nil
+}
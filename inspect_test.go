@@ -0,0 +1,124 @@
+package sparsecat
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// writeStream writes a stream of f with the given header and sections. The data of the sections is taken from data.
+func writeStream(t *testing.T, f format.Format, header format.Header, sections []format.Section, data []byte) []byte {
+	t.Helper()
+
+	f = format.ForStream(f)
+
+	var stream bytes.Buffer
+	write := func(reader io.Reader, length int64) {
+		written, err := io.Copy(&stream, reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if written != length {
+			t.Fatalf("expected a reader of %d bytes, got %d", length, written)
+		}
+	}
+
+	write(format.GetHeaderReader(f, header))
+	for _, section := range sections {
+		var source io.Reader
+		if !section.Zero {
+			source = bytes.NewReader(data[section.Offset : section.Offset+section.Length])
+		}
+		write(f.GetSectionReader(source, section))
+	}
+	write(f.GetEndTagReader())
+
+	return stream.Bytes()
+}
+
+func TestInspect(t *testing.T) {
+	const kib = 1024
+
+	data := fill(fill(make([]byte, 64*kib), 0, 4*kib, 1), 8*kib, 8*kib, 2)
+	sections := []format.Section{
+		{Offset: 0, Length: 4 * kib},
+		{Offset: 8 * kib, Length: 8 * kib},
+		{Offset: 32 * kib, Length: 4 * kib, Zero: true},
+	}
+
+	tests := []struct {
+		name     string
+		format   format.Format
+		header   format.Header
+		sections []format.Section
+		expected StreamInfo
+	}{
+		{
+			name:     "rbd-diff-v1",
+			format:   format.RbdDiffv1,
+			header:   format.Header{Size: 64 * kib, FromSnapshot: "snap1", ToSnapshot: "snap2"},
+			sections: sections,
+			expected: StreamInfo{
+				Header:    format.Header{Size: 64 * kib, FromSnapshot: "snap1", ToSnapshot: "snap2"},
+				DataBytes: 12 * kib, ZeroBytes: 4 * kib, HoleBytes: 48 * kib, LargestSection: 8 * kib,
+				Sections: sections,
+			},
+		},
+		{
+			name:     "rbd-diff-v2",
+			format:   format.RbdDiffv2,
+			header:   format.Header{Size: 64 * kib, ToSnapshot: "snap1"},
+			sections: sections,
+			expected: StreamInfo{
+				Header:    format.Header{Size: 64 * kib, ToSnapshot: "snap1"},
+				DataBytes: 12 * kib, ZeroBytes: 4 * kib, HoleBytes: 48 * kib, LargestSection: 8 * kib,
+				Sections: sections,
+			},
+		},
+		{
+			name:     "sparsecat-v1",
+			format:   format.SparsecatV1,
+			header:   format.Header{Size: 64 * kib},
+			sections: sections,
+			expected: StreamInfo{
+				Header:    format.Header{Size: 64 * kib},
+				DataBytes: 12 * kib, ZeroBytes: 4 * kib, HoleBytes: 48 * kib, LargestSection: 8 * kib,
+				Sections: sections,
+			},
+		},
+		{
+			name:     "empty file",
+			format:   format.RbdDiffv1,
+			header:   format.Header{Size: 64 * kib},
+			sections: []format.Section{},
+			expected: StreamInfo{Header: format.Header{Size: 64 * kib}, HoleBytes: 64 * kib, Sections: []format.Section{}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := writeStream(t, test.format, test.header, test.sections, data)
+
+			info, err := Inspect(bytes.NewReader(stream), test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(*info, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, *info)
+			}
+
+			// a stream missing its end tag or part of a section is rejected
+			for length := 0; length < len(stream); length++ {
+				_, err = Inspect(bytes.NewReader(stream[:length]), test.format)
+				if err == nil {
+					t.Errorf("expected an error inspecting a stream truncated to %d bytes", length)
+				}
+			}
+		})
+	}
+}
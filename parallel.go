@@ -0,0 +1,253 @@
+package sparsecat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// splitAlignment is the granularity of the boundaries between the ranges returned by SplitExtents
+const splitAlignment = 4096
+
+// handshakeTimeout limits the time ReceiveParallel waits for the handshake of an accepted connection, as the
+// connections of the other streams can't be accepted in the meantime
+var handshakeTimeout = 30 * time.Second
+
+// SplitExtents divides source into at most n consecutive ranges that contain roughly the same amount of data.
+// Together the ranges cover the entire source, holes included. Fewer ranges are returned when there isn't
+// enough data to divide.
+func SplitExtents(source ExtentSource, n int) ([]Extent, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of ranges %d", n)
+	}
+
+	size, err := source.Size()
+	if err != nil {
+		return nil, fmt.Errorf("error determining size of source: %w", err)
+	}
+
+	var extents []Extent
+	var total int64
+	for offset := int64(0); offset < size; {
+		start, end, err := source.NextExtent(offset)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error detecting data section: %w", err)
+		}
+
+		if end > size {
+			end = size
+		}
+
+		if end <= start {
+			break
+		}
+
+		extents = append(extents, Extent{Offset: start, Length: end - start})
+		total += end - start
+		offset = end
+	}
+
+	ranges := make([]Extent, 0, n)
+	rangeStart := int64(0)
+
+	// walk the extents and place a boundary each time another 1/n of the data has been passed
+	var passed int64
+	next := 1
+	for _, extent := range extents {
+		for next < n {
+			target := total * int64(next) / int64(n)
+			if passed+extent.Length <= target {
+				break
+			}
+
+			boundary := extent.Offset + (target - passed)
+			boundary -= boundary % splitAlignment
+			next++
+
+			if boundary <= rangeStart {
+				continue
+			}
+
+			ranges = append(ranges, Extent{Offset: rangeStart, Length: boundary - rangeStart})
+			rangeStart = boundary
+		}
+
+		passed += extent.Length
+	}
+
+	return append(ranges, Extent{Offset: rangeStart, Length: size - rangeStart}), nil
+}
+
+// NewParallelEncoders creates an Encoder for each of at most n ranges of file, as divided by SplitExtents. The
+// Encoders can be read concurrently, for example to send each one over its own connection. Every stream describes
+// the size of the whole file, so the streams can be written to the same target in any order.
+func NewParallelEncoders(file *os.File, n int) ([]*Encoder, error) {
+	source, err := NewFileExtentSource(file)
+	if err != nil {
+		return nil, fmt.Errorf("error determining extent source: %w", err)
+	}
+
+	ranges, err := SplitExtents(source, n)
+	if err != nil {
+		return nil, err
+	}
+
+	encoders := make([]*Encoder, len(ranges))
+	for i, r := range ranges {
+		encoders[i] = NewEncoder(file)
+		encoders[i].Offset = r.Offset
+		encoders[i].Length = r.Length
+	}
+
+	return encoders, nil
+}
+
+// SendParallel sends each of streams over its own connection returned by dial. The streams are sent concurrently
+// and the handshake is extended with the number of streams and the index of each stream, so the receiving side
+// knows how many connections to expect. The first error encountered is returned once all streams have finished.
+func SendParallel(dial func() (net.Conn, error), handshake Handshake, streams []io.Reader) error {
+	if len(streams) == 0 {
+		return errors.New("no streams to send")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(streams))
+
+	for i, stream := range streams {
+		wg.Add(1)
+		go func(index int, stream io.Reader) {
+			defer wg.Done()
+
+			conn, err := dial()
+			if err != nil {
+				errs[index] = fmt.Errorf("error connecting: %w", err)
+				return
+			}
+			defer conn.Close()
+
+			streamHandshake := handshake
+			streamHandshake.Streams = len(streams)
+			streamHandshake.Stream = index
+
+			_, err = Send(conn, streamHandshake, stream)
+			if err != nil {
+				errs[index] = fmt.Errorf("error sending stream %d: %w", index, err)
+			}
+		}(i, stream)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReceiveParallel accepts connections from listener until every stream of a transfer has been received. A transfer
+// consists of the number of streams announced in the handshake of the sending side, or a single stream when the
+// sending side doesn't use SendParallel. The streams are received concurrently, so write must be safe for concurrent
+// use. The first error encountered is returned once all accepted streams have finished.
+func ReceiveParallel(listener net.Listener, handshake Handshake, write func(remote Handshake, stream io.Reader) error) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	received := make(map[int]bool)
+	streams := 0
+
+	for streams == 0 || len(received) < streams {
+		conn, err := listener.Accept()
+		if err != nil {
+			fail(fmt.Errorf("error accepting connection: %w", err))
+			break
+		}
+
+		// ReceiveHandshake reports the handshakes it rejects itself
+		remote, err := receiveHandshake(conn, handshake)
+		if err == nil {
+			err = checkStream(remote, streams, received)
+			if err != nil {
+				_ = writeError(conn, err)
+			}
+		}
+
+		if err != nil {
+			conn.Close()
+			fail(err)
+			break
+		}
+
+		if streams == 0 {
+			streams = remote.streamCount()
+		}
+		received[remote.Stream] = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			err := receiveStream(conn, remote, write)
+			if err != nil {
+				fail(fmt.Errorf("error receiving stream %d: %w", remote.Stream, err))
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// receiveHandshake performs the handshake of an accepted connection within handshakeTimeout, so a connection that
+// never sends its handshake doesn't block the transfer forever
+func receiveHandshake(conn net.Conn, handshake Handshake) (Handshake, error) {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return Handshake{}, fmt.Errorf("error setting handshake deadline: %w", err)
+	}
+
+	remote, err := ReceiveHandshake(conn, handshake)
+	if err != nil {
+		return remote, err
+	}
+
+	return remote, conn.SetDeadline(time.Time{})
+}
+
+// checkStream verifies the handshake of a stream belongs to the transfer that is being received
+func checkStream(remote Handshake, streams int, received map[int]bool) error {
+	if streams != 0 && remote.streamCount() != streams {
+		return fmt.Errorf("expected a transfer of %d streams but got %d", streams, remote.streamCount())
+	}
+
+	if remote.Stream < 0 || remote.Stream >= remote.streamCount() {
+		return fmt.Errorf("invalid stream %d of %d", remote.Stream, remote.streamCount())
+	}
+
+	if received[remote.Stream] {
+		return fmt.Errorf("stream %d has already been received", remote.Stream)
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package sparsecat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitExtents(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		extents  []Extent
+		n        int
+		expected []Extent
+	}{
+		{
+			name:     "single range",
+			size:     100 * 1024,
+			extents:  []Extent{{Offset: 0, Length: 4096}},
+			n:        1,
+			expected: []Extent{{Offset: 0, Length: 100 * 1024}},
+		},
+		{
+			name:     "single extent",
+			size:     64 * 1024,
+			extents:  []Extent{{Offset: 0, Length: 32 * 1024}},
+			n:        2,
+			expected: []Extent{{Offset: 0, Length: 16 * 1024}, {Offset: 16 * 1024, Length: 48 * 1024}},
+		},
+		{
+			name:     "uneven extents",
+			size:     128 * 1024,
+			extents:  []Extent{{Offset: 0, Length: 4096}, {Offset: 40960, Length: 12288}, {Offset: 102400, Length: 4096}},
+			n:        2,
+			expected: []Extent{{Offset: 0, Length: 45056}, {Offset: 45056, Length: 86016}},
+		},
+		{
+			name:    "uneven extents in four ranges",
+			size:    128 * 1024,
+			extents: []Extent{{Offset: 0, Length: 4096}, {Offset: 40960, Length: 12288}, {Offset: 102400, Length: 4096}},
+			n:       4,
+			expected: []Extent{
+				{Offset: 0, Length: 40960},
+				{Offset: 40960, Length: 4096},
+				{Offset: 45056, Length: 4096},
+				{Offset: 49152, Length: 81920},
+			},
+		},
+		{
+			name:     "more ranges than data",
+			size:     64 * 1024,
+			extents:  []Extent{{Offset: 8192, Length: 4096}},
+			n:        8,
+			expected: []Extent{{Offset: 0, Length: 8192}, {Offset: 8192, Length: 57344}},
+		},
+		{
+			name:     "no data",
+			size:     64 * 1024,
+			n:        4,
+			expected: []Extent{{Offset: 0, Length: 64 * 1024}},
+		},
+		{
+			name:     "empty source",
+			size:     0,
+			n:        4,
+			expected: []Extent{{Offset: 0, Length: 0}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranges, err := SplitExtents(NewExtentListSource(test.size, test.extents), test.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(ranges, test.expected) {
+				t.Errorf("expected ranges %v, got %v", test.expected, ranges)
+			}
+		})
+	}
+
+	_, err := SplitExtents(NewExtentListSource(4096, nil), 0)
+	if err == nil {
+		t.Error("expected an error splitting into zero ranges")
+	}
+}
+
+// receiveParallel runs ReceiveParallel on a loopback listener, writing the streams to target. The result is sent on
+// the returned channel.
+func receiveParallel(t *testing.T, handshake Handshake, target *os.File) (net.Listener, chan error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ReceiveParallel(listener, handshake, func(remote Handshake, stream io.Reader) error {
+			// the target is truncated up front, the streams only write their own ranges
+			decoder := NewDecoder(stream)
+			decoder.DisableFileTruncate = true
+			_, err := io.Copy(target, decoder)
+			return err
+		})
+	}()
+
+	return listener, done
+}
+
+func TestParallelTransfer(t *testing.T) {
+	const blockSize = 4096
+	const size = 64*blockSize + 100
+
+	// most of the data is at the start, so the ranges differ in size
+	blocks := map[int64]byte{0: 1, 1: 2, 2: 3, 3: 4, 5: 5, 6: 6, 20: 7, 41: 8, 63: 9, 64: 10}
+
+	for _, n := range []int{1, 3, 4, 8} {
+		t.Run(fmt.Sprintf("%d streams", n), func(t *testing.T) {
+			source := sparseFile(t, "source", size, blockSize, blocks)
+			target := sparseFile(t, "target", size, blockSize, nil)
+
+			encoders, err := NewParallelEncoders(source, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n > 1 && len(encoders) < 2 {
+				t.Fatalf("expected the file to be split into several streams, got %d", len(encoders))
+			}
+
+			streams := make([]io.Reader, len(encoders))
+			for i, encoder := range encoders {
+				streams[i] = encoder
+			}
+
+			listener, done := receiveParallel(t, Handshake{}, target)
+
+			err = SendParallel(func() (net.Conn, error) {
+				return net.Dial("tcp", listener.Addr().String())
+			}, Handshake{Format: "rbd-diff-v1"}, streams)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = <-done
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := os.ReadFile(source.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := os.ReadFile(target.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(actual, expected) {
+				t.Error("target doesn't match the source after the transfer")
+			}
+		})
+	}
+}
+
+func TestReceiveParallelRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake Handshake
+		// request is the handshake sent by the connecting side
+		request string
+	}{
+		{
+			name:      "format mismatch",
+			handshake: Handshake{Format: "sparsecat-v1"},
+			request:   "SPARSECAT/1\nformat rbd-diff-v1\noffset 0\n\n",
+		},
+		{
+			name:    "invalid stream",
+			request: "SPARSECAT/1\nformat rbd-diff-v1\noffset 0\nstreams 2\nstream 5\n\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := sparseFile(t, "target", 0, 4096, nil)
+			listener, done := receiveParallel(t, test.handshake, target)
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = io.WriteString(conn, test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = <-done
+			if err == nil {
+				t.Error("expected ReceiveParallel to fail")
+			}
+
+			// the rejection is reported exactly once
+			if strings.Count(string(response), handshakeError+" ") != 1 {
+				t.Errorf("expected a single error to be sent, got %q", response)
+			}
+		})
+	}
+}
+
+func TestReceiveParallelHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	target := sparseFile(t, "target", 0, 4096, nil)
+	listener, done := receiveParallel(t, Handshake{}, target)
+
+	// connect without ever sending the handshake
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Error("expected ReceiveParallel to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiveParallel is still waiting for the handshake")
+	}
+}
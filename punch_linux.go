@@ -0,0 +1,19 @@
+package sparsecat
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// PunchHole deallocates the range of file starting at offset, which reads as zeros afterwards. The size of the file
+// is not changed. ErrPunchHoleUnsupported is returned when the filesystem doesn't support punching holes.
+func PunchHole(file *os.File, offset int64, length int64) error {
+	err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return ErrPunchHoleUnsupported
+	}
+
+	return err
+}
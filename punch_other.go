@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package sparsecat
+
+import "os"
+
+// PunchHole is not supported on this platform and always returns ErrPunchHoleUnsupported.
+func PunchHole(file *os.File, offset int64, length int64) error {
+	return ErrPunchHoleUnsupported
+}
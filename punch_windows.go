@@ -0,0 +1,37 @@
+package sparsecat
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const setZeroData = 0x000980c8
+
+// fileZeroDataInformation is FILE_ZERO_DATA_INFORMATION
+type fileZeroDataInformation struct {
+	FileOffset      int64
+	BeyondFinalZero int64
+}
+
+// PunchHole deallocates the range of file starting at offset, which reads as zeros afterwards. The size of the file
+// is not changed. The file must have been marked sparse, for example by SparseTruncate. ErrPunchHoleUnsupported is
+// returned when the filesystem doesn't support punching holes.
+func PunchHole(file *os.File, offset int64, length int64) error {
+	info := fileZeroDataInformation{FileOffset: offset, BeyondFinalZero: offset + length}
+
+	err := windows.DeviceIoControl(
+		windows.Handle(file.Fd()), setZeroData,
+		(*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)),
+		nil, 0,
+		nil, nil,
+	)
+
+	if errors.Is(err, windows.ERROR_INVALID_FUNCTION) || errors.Is(err, windows.ERROR_NOT_SUPPORTED) {
+		return ErrPunchHoleUnsupported
+	}
+
+	return err
+}
@@ -0,0 +1,124 @@
+package sparsecat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ResumeStateSuffix is appended to the name of the target file to get the name of its resume state file.
+const ResumeStateSuffix = ".sparsecat-resume"
+
+// ResumeState records the progress of a Decoder in a file next to the target, so an interrupted transfer can
+// be resumed from the last checkpoint. The size of the file being transferred is recorded as well, so resuming
+// with the stream of another file is detected. The state file is not synced to disk, it protects against
+// interrupted transfers but not against losing power.
+type ResumeState struct {
+	file   *os.File
+	offset int64
+	// size is the size of the file being transferred, -1 until it is known
+	size int64
+}
+
+// OpenResumeState opens or creates the resume state of the target file with the given name.
+func OpenResumeState(targetName string) (*ResumeState, error) {
+	file, err := os.OpenFile(targetName+ResumeStateSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening resume state: %w", err)
+	}
+
+	state := &ResumeState{file: file, size: -1}
+
+	var buf [64]byte
+	read, err := file.ReadAt(buf[:], 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		file.Close()
+		return nil, fmt.Errorf("error reading resume state: %w", err)
+	}
+
+	content := strings.TrimSpace(string(buf[:read]))
+	if content != "" {
+		err = state.parse(content)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid resume state %q: %w", content, err)
+		}
+	}
+
+	return state, nil
+}
+
+// parse parses the offset and size of a state file
+func (r *ResumeState) parse(content string) error {
+	fields := strings.Fields(content)
+	if len(fields) != 2 {
+		return errors.New("expected an offset and a size")
+	}
+
+	var err error
+	r.offset, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	r.size, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if r.offset < 0 || r.size < 0 || r.offset > r.size {
+		return fmt.Errorf("offset %d doesn't fit in a file of %d bytes", r.offset, r.size)
+	}
+
+	return nil
+}
+
+// Offset returns the offset up to which the target has been written. Pass it to Encoder.Offset to resume.
+func (r *ResumeState) Offset() int64 {
+	return r.offset
+}
+
+// Start checks the stream being received is of a file of the size the state was recorded for, and records the
+// size when the state is new. Pass it the size of the header read using Decoder.ReadHeader before decoding.
+func (r *ResumeState) Start(size int64) error {
+	if r.size >= 0 && r.size != size {
+		return fmt.Errorf("the resume state belongs to a file of %d bytes but the stream contains a file of %d bytes, remove %s to start over", r.size, size, r.file.Name())
+	}
+
+	return r.write(r.offset, size)
+}
+
+// Checkpoint records that everything in front of offset has been written. It can be used as Decoder.Checkpoint.
+func (r *ResumeState) Checkpoint(offset int64) error {
+	if r.size < 0 {
+		return errors.New("the resume state has not been started")
+	}
+
+	return r.write(offset, r.size)
+}
+
+func (r *ResumeState) write(offset int64, size int64) error {
+	// use a fixed width so the previous checkpoint is always overwritten completely
+	_, err := r.file.WriteAt([]byte(fmt.Sprintf("%020d %020d\n", offset, size)), 0)
+	if err != nil {
+		return err
+	}
+
+	r.offset = offset
+	r.size = size
+	return nil
+}
+
+// Close closes the state file, keeping it for a later attempt.
+func (r *ResumeState) Close() error {
+	return r.file.Close()
+}
+
+// Remove closes and removes the state file. It should be called once the transfer has completed.
+func (r *ResumeState) Remove() error {
+	r.file.Close()
+	return os.Remove(r.file.Name())
+}
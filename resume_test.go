@@ -0,0 +1,246 @@
+package sparsecat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeState(t *testing.T) {
+	tests := []struct {
+		name string
+		// content is the content of the state file, nil when there is none
+		content        []byte
+		expectedOffset int64
+		expectError    bool
+		// size is passed to Start, startError tells whether it is expected to fail
+		size       int64
+		startError bool
+	}{
+		{name: "new state", size: 1000},
+		{name: "empty state", content: []byte{}, size: 1000},
+		{name: "recorded state", content: []byte("00000000000000000512 00000000000000001000\n"), expectedOffset: 512, size: 1000},
+		{name: "other file", content: []byte("512 1000\n"), expectedOffset: 512, size: 2000, startError: true},
+		{name: "offset only", content: []byte("512\n"), expectError: true},
+		{name: "not a number", content: []byte("512 abc\n"), expectError: true},
+		{name: "negative offset", content: []byte("-1 1000\n"), expectError: true},
+		{name: "offset beyond size", content: []byte("2000 1000\n"), expectError: true},
+		{name: "garbage", content: []byte("\x00\x01\x02"), expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "target")
+			if test.content != nil {
+				err := os.WriteFile(target+ResumeStateSuffix, test.content, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state, err := OpenResumeState(target)
+			if test.expectError {
+				if err == nil {
+					state.Close()
+					t.Fatal("expected an error opening the state")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer state.Close()
+
+			if state.Offset() != test.expectedOffset {
+				t.Errorf("expected offset %d, got %d", test.expectedOffset, state.Offset())
+			}
+
+			err = state.Start(test.size)
+			if test.startError {
+				if err == nil {
+					t.Error("expected an error starting a state of another file")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = state.Checkpoint(test.size / 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state.Close()
+
+			// the checkpoint and size survive reopening the state
+			state, err = OpenResumeState(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if state.Offset() != test.size/2 {
+				t.Errorf("expected offset %d after reopening, got %d", test.size/2, state.Offset())
+			}
+
+			if state.Start(test.size+1) == nil {
+				t.Error("expected an error starting the state with another size")
+			}
+
+			err = state.Remove()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = os.Stat(target + ResumeStateSuffix)
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected the state file to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResumeStateCheckpointBeforeStart(t *testing.T) {
+	state, err := OpenResumeState(filepath.Join(t.TempDir(), "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if state.Checkpoint(100) == nil {
+		t.Error("expected an error recording a checkpoint before starting the state")
+	}
+}
+
+// errInterrupted interrupts a transfer after a number of checkpoints
+var errInterrupted = errors.New("interrupted")
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	const blockSize = 4096
+
+	tests := []struct {
+		name string
+		// interruptAfter is the number of checkpoints after which the first transfer stops
+		interruptAfter int
+		offset         int64
+		length         int64
+	}{
+		{name: "interrupted after the first section", interruptAfter: 1},
+		{name: "interrupted halfway", interruptAfter: 3},
+		{name: "interrupted at the last section", interruptAfter: 5},
+		{name: "range", interruptAfter: 2, offset: 4 * blockSize, length: 20 * blockSize},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			const size = 32*blockSize + 100
+			source := sparseFile(t, "source", size, blockSize, map[int64]byte{0: 1, 5: 2, 9: 3, 14: 4, 20: 5, 32: 6})
+			targetName := filepath.Join(t.TempDir(), "target")
+
+			transfer := func(interruptAfter int) error {
+				state, err := OpenResumeState(targetName)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				encoder := NewEncoder(source)
+				encoder.Offset, encoder.Length = test.offset, test.length
+				if state.Offset() > test.offset {
+					encoder.Offset = state.Offset()
+					if test.length > 0 {
+						encoder.Length = test.offset + test.length - state.Offset()
+					}
+				}
+
+				target, err := os.OpenFile(targetName, os.O_RDWR|os.O_CREATE, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer target.Close()
+
+				decoder := NewDecoder(encoder)
+				decoder.Offset = state.Offset()
+
+				checkpoints := 0
+				decoder.Checkpoint = func(offset int64) error {
+					err := state.Checkpoint(offset)
+					checkpoints++
+					if err == nil && checkpoints == interruptAfter {
+						err = errInterrupted
+					}
+					return err
+				}
+
+				header, err := decoder.ReadHeader()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = state.Start(header.Size)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = io.Copy(target, decoder)
+				if err != nil {
+					state.Close()
+					return err
+				}
+
+				return state.Remove()
+			}
+
+			err := transfer(test.interruptAfter)
+			if !errors.Is(err, errInterrupted) {
+				t.Fatalf("expected the first transfer to be interrupted, got %v", err)
+			}
+
+			err = transfer(-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := os.ReadFile(source.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.length > 0 {
+				expected = append(make([]byte, test.offset), expected[test.offset:test.offset+test.length]...)
+				expected = append(expected, make([]byte, size-len(expected))...)
+			}
+
+			actual, err := os.ReadFile(targetName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(actual, expected) {
+				t.Error("target doesn't match the source after resuming")
+			}
+		})
+	}
+}
+
+func TestResumeRequiresSparseWriting(t *testing.T) {
+	data := encodeBytes(t, make([]byte, 8192))
+
+	decoder := NewDecoder(bytes.NewReader(data))
+	decoder.Offset = 4096
+	decoder.DisableSparseWriting = true
+
+	target, err := os.Create(filepath.Join(t.TempDir(), "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	_, err = io.Copy(target, decoder)
+	if err == nil {
+		t.Error("expected an error resuming without sparse writing")
+	}
+}
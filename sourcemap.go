@@ -0,0 +1,96 @@
+package sparsecat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// SourceMap describes the sections an Encoder sends for its source.
+type SourceMap struct {
+	// Size is the file size written to the stream.
+	Size int64 `json:"size"`
+	// AllocatedBytes is the amount of data found by hole detection in the range being encoded. Sources without hole
+	// detection, such as block devices, are allocated entirely.
+	AllocatedBytes int64 `json:"allocatedBytes"`
+	// DataBytes is the amount of data sent in the sections of the stream. It is less than AllocatedBytes when
+	// zero blocks are skipped.
+	DataBytes int64 `json:"dataBytes"`
+	// StreamSize is the size of the entire stream, including the framing added by the format.
+	StreamSize int64 `json:"streamSize"`
+	// Sections lists the data sections in the order they are sent.
+	Sections []format.Section `json:"sections"`
+}
+
+// Map walks the source the same way Read does and describes the stream Read would produce, without producing it.
+// Data is only read from the source when the Encoder has to scan for zero blocks or when the format compresses
+// sections, and it isn't added to the stream digest of sparsecat-v1. The Encoder can't be used to Read the stream
+// afterwards.
+func (e *Encoder) Map() (*SourceMap, error) {
+	err := e.start()
+	if err != nil {
+		return nil, err
+	}
+
+	allocated, err := e.allocatedBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	sourceMap := &SourceMap{
+		Size:           e.reportedSize(),
+		AllocatedBytes: allocated,
+		StreamSize:     e.currentSectionLength,
+		Sections:       []format.Section{},
+	}
+
+	for {
+		e.currentOffset = e.currentSectionEnd
+
+		err = e.parseSection()
+		if err != nil {
+			return nil, err
+		}
+
+		// the section isn't read, so errors of the format have to be checked explicitly
+		err = format.ReaderError(e.currentSection)
+		if err != nil {
+			return nil, err
+		}
+
+		sourceMap.StreamSize += e.currentSectionLength
+		if e.done {
+			return sourceMap, nil
+		}
+
+		sourceMap.Sections = append(sourceMap.Sections, e.currentSectionInfo)
+		sourceMap.DataBytes += e.currentSectionInfo.Length
+	}
+}
+
+// allocatedBytes returns the amount of data the extent source reports in the range being encoded
+func (e *Encoder) allocatedBytes() (int64, error) {
+	var allocated int64
+	for offset := e.Offset; offset < e.rangeEnd; {
+		start, end, err := e.extents.NextExtent(offset)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("error detecting data section: %w", err)
+		}
+
+		start, end = maxInt64(start, offset), minInt64(end, e.rangeEnd)
+		if end <= start {
+			break
+		}
+
+		allocated += end - start
+		offset = end
+	}
+
+	return allocated, nil
+}
@@ -0,0 +1,125 @@
+package sparsecat
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+func TestMap(t *testing.T) {
+	const blockSize = 4096
+	const size = 32*blockSize + 100
+
+	gzip, err := format.SparsecatV1.(format.CompressingFormat).WithCodec("gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		format    format.Format
+		configure func(encoder *Encoder)
+		// expectedAllocated is the amount of data in the range found by hole detection
+		expectedAllocated int64
+		expectedData      int64
+	}{
+		{name: "rbd-diff-v1", format: format.RbdDiffv1, expectedAllocated: 5*blockSize + 100, expectedData: 5*blockSize + 100},
+		{name: "rbd-diff-v2", format: format.RbdDiffv2, expectedAllocated: 5*blockSize + 100, expectedData: 5*blockSize + 100},
+		{name: "rbd-export-v2", format: format.RbdExportv2, expectedAllocated: 5*blockSize + 100, expectedData: 5*blockSize + 100},
+		{name: "sparsecat-v1", format: format.SparsecatV1, expectedAllocated: 5*blockSize + 100, expectedData: 5*blockSize + 100},
+		{name: "compressed", format: gzip, expectedAllocated: 5*blockSize + 100, expectedData: 5*blockSize + 100},
+		{
+			name:              "zero blocks",
+			format:            format.SparsecatV1,
+			configure:         func(encoder *Encoder) { encoder.DetectZeroBlocks = true },
+			expectedAllocated: 5*blockSize + 100,
+			expectedData:      4*blockSize + 100,
+		},
+		{
+			name:              "small sections",
+			format:            format.RbdDiffv1,
+			configure:         func(encoder *Encoder) { encoder.MaxSectionSize = 1000 },
+			expectedAllocated: 5*blockSize + 100,
+			expectedData:      5*blockSize + 100,
+		},
+		{
+			name:   "range",
+			format: format.RbdDiffv1,
+			configure: func(encoder *Encoder) {
+				encoder.Offset = 2 * blockSize
+				encoder.Length = 10 * blockSize
+			},
+			expectedAllocated: 3 * blockSize,
+			expectedData:      3 * blockSize,
+		},
+		{
+			name:   "range size",
+			format: format.SparsecatV1,
+			configure: func(encoder *Encoder) {
+				encoder.Offset = 2 * blockSize
+				encoder.Length = 10 * blockSize
+				encoder.ReportRangeSize = true
+			},
+			expectedAllocated: 3 * blockSize,
+			expectedData:      3 * blockSize,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// block 1 is allocated but only contains zeros
+			source := sparseFile(t, "source", size, blockSize, map[int64]byte{0: 1, 1: 0, 2: 2, 3: 3, 10: 4, 32: 5})
+
+			newEncoder := func() *Encoder {
+				encoder := NewEncoder(source)
+				encoder.Format = test.format
+				if test.configure != nil {
+					test.configure(encoder)
+				}
+				return encoder
+			}
+
+			sourceMap, err := newEncoder().Map()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stream, err := io.ReadAll(newEncoder())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := Inspect(bytes.NewReader(stream), test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sourceMap.StreamSize != int64(len(stream)) {
+				t.Errorf("expected a stream of %d bytes, the stream is %d bytes", sourceMap.StreamSize, len(stream))
+			}
+
+			if sourceMap.Size != info.Size {
+				t.Errorf("expected size %d, the stream contains %d", sourceMap.Size, info.Size)
+			}
+
+			if sourceMap.DataBytes != info.DataBytes {
+				t.Errorf("expected %d bytes of data, the stream contains %d", sourceMap.DataBytes, info.DataBytes)
+			}
+
+			if !reflect.DeepEqual(sourceMap.Sections, info.Sections) {
+				t.Errorf("expected sections %+v, the stream contains %+v", sourceMap.Sections, info.Sections)
+			}
+
+			if sourceMap.DataBytes != test.expectedData {
+				t.Errorf("expected %d bytes of data to be sent, got %d", test.expectedData, sourceMap.DataBytes)
+			}
+
+			if sourceMap.AllocatedBytes != test.expectedAllocated {
+				t.Errorf("expected %d allocated bytes, got %d", test.expectedAllocated, sourceMap.AllocatedBytes)
+			}
+		})
+	}
+}
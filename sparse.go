@@ -1,48 +1,53 @@
 package sparsecat
 
 import (
-	"bytes"
-	"errors"
-	"io"
 	"os"
 )
 
 const BLK_READ_BUFFER = 4_000_000 // 4MB
 
-func isBlockDevice(fi os.FileInfo) bool {
+// IsBlockDevice reports whether fi describes a device, which can't be truncated and doesn't report its size through
+// stat. Raw disks are character devices on BSD and macOS, so character devices are included.
+func IsBlockDevice(fi os.FileInfo) bool {
 	return fi.Mode()&os.ModeDevice == os.ModeDevice
 }
 
-// slowDetectDataSection detects data sections by reading a buffer at the time, discarding any that don't contain
-// data. Only returns EOF when there is no data to be copied anymore
-func slowDetectDataSection(file io.Reader, currentOffset int64) (start int64, end int64, reader io.Reader, err error) {
-	var buf [BLK_READ_BUFFER]byte
-
-	for {
-		read, err := file.Read(buf[:])
-		if err != nil && !errors.Is(err, io.EOF) {
-			return 0, 0, nil, err
+func isBufferEmpty(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
 		}
+	}
+	return true
+}
 
-		if read == 0 && errors.Is(err, io.EOF) {
-			return 0, 0, nil, err
+// findDataBlocks divides buf into blocks of blockSize bytes and returns the start and end of the first run of
+// blocks that contain data. The last block may be smaller than blockSize. When buf only contains zeros both
+// start and end are equal to len(buf).
+func findDataBlocks(buf []byte, blockSize int) (start int, end int) {
+	start = len(buf)
+	for offset := 0; offset < len(buf); offset += blockSize {
+		if !isBufferEmpty(buf[offset:minInt(offset+blockSize, len(buf))]) {
+			start = offset
+			break
 		}
+	}
 
-		// buffer is empty, discard data but advance offset unless EOF
-		if isBufferEmpty(buf[:read]) {
-			currentOffset += int64(read)
-			continue
+	end = start
+	for end < len(buf) {
+		blockEnd := minInt(end+blockSize, len(buf))
+		if isBufferEmpty(buf[end:blockEnd]) {
+			break
 		}
-
-		return currentOffset, currentOffset + int64(read), bytes.NewReader(buf[:read]), nil
+		end = blockEnd
 	}
+
+	return start, end
 }
 
-func isBufferEmpty(buf []byte) bool {
-	for _, b := range buf {
-		if b != 0 {
-			return false
-		}
+func minInt(a, b int) int {
+	if a < b {
+		return a
 	}
-	return true
+	return b
 }
@@ -0,0 +1,67 @@
+package sparsecat
+
+import (
+	"testing"
+)
+
+func TestFindDataBlocks(t *testing.T) {
+	tests := []struct {
+		name      string
+		buf       []byte
+		blockSize int
+		start     int
+		end       int
+	}{
+		{
+			name:      "empty buffer",
+			buf:       []byte{},
+			blockSize: 4,
+			start:     0,
+			end:       0,
+		},
+		{
+			name:      "only zeros",
+			buf:       make([]byte, 16),
+			blockSize: 4,
+			start:     16,
+			end:       16,
+		},
+		{
+			name:      "only data",
+			buf:       fill(make([]byte, 16), 0, 16, 1),
+			blockSize: 4,
+			start:     0,
+			end:       16,
+		},
+		{
+			name:      "data rounded to blocks",
+			buf:       fill(make([]byte, 16), 5, 4, 1),
+			blockSize: 4,
+			start:     4,
+			end:       12,
+		},
+		{
+			name:      "first run only",
+			buf:       fill(fill(make([]byte, 16), 0, 1, 1), 12, 1, 1),
+			blockSize: 4,
+			start:     0,
+			end:       4,
+		},
+		{
+			name:      "partial last block",
+			buf:       fill(make([]byte, 14), 13, 1, 1),
+			blockSize: 4,
+			start:     12,
+			end:       14,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end := findDataBlocks(test.buf, test.blockSize)
+			if start != test.start || end != test.end {
+				t.Errorf("expected %d-%d, got %d-%d", test.start, test.end, start, end)
+			}
+		})
+	}
+}
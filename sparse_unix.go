@@ -49,6 +49,11 @@ func detectDataSection(file *os.File, offset int64) (start int64, end int64, err
 	return startOfData, endOfData, err
 }
 
+// NewSeekHoleSource returns an ExtentSource that uses SEEK_DATA and SEEK_HOLE to find the data in file.
+func NewSeekHoleSource(file *os.File) ExtentSource {
+	return fileExtentSource{file: file}
+}
+
 func supportsSeekHole(file *os.File) bool {
 	_, err := file.Seek(0, SEEK_DATA)
 	var syserr syscall.Errno
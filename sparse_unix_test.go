@@ -0,0 +1,37 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package sparsecat
+
+import (
+	"testing"
+)
+
+func TestSeekHoleSource(t *testing.T) {
+	const blockSize = 64 * 1024
+
+	file := sparseFile(t, "source", 16*blockSize, blockSize, map[int64]byte{1: 1, 2: 2, 8: 3})
+	if !supportsSeekHole(file) {
+		t.Skip("the filesystem doesn't support SEEK_DATA and SEEK_HOLE")
+	}
+
+	source := NewSeekHoleSource(file)
+
+	size, err := source.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 16*blockSize {
+		t.Errorf("expected size %d, got %d", 16*blockSize, size)
+	}
+
+	extents := collectExtents(t, source)
+
+	// filesystems may report more data than was written, but every written block must be part of an extent
+	for _, written := range []Extent{{1 * blockSize, 2 * blockSize}, {8 * blockSize, blockSize}} {
+		if !coversExtent(extents, written) {
+			t.Errorf("the data at %d-%d isn't reported, got extents %v", written.Offset, written.Offset+written.Length, extents)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package sparsecat
 
 import (
 	"errors"
+	"fmt"
 	"golang.org/x/sys/windows"
 	"io"
 	"os"
@@ -42,7 +43,7 @@ func detectDataSection(file *os.File, offset int64) (start int64, end int64, err
 
 	if err != nil {
 		if !errors.Is(err, syscall.ERROR_MORE_DATA) {
-			panic(err)
+			return 0, 0, fmt.Errorf("error querying allocated ranges: %w", err)
 		}
 	}
 
@@ -54,6 +55,11 @@ func detectDataSection(file *os.File, offset int64) (start int64, end int64, err
 	return allocRanges[0].offset, allocRanges[0].offset + allocRanges[0].length, nil
 }
 
+// NewAllocatedRangesSource returns an ExtentSource that uses FSCTL_QUERY_ALLOCATED_RANGES to find the data in file.
+func NewAllocatedRangesSource(file *os.File) ExtentSource {
+	return fileExtentSource{file: file}
+}
+
 func supportsSeekHole(f *os.File) bool {
 	return true
 }
@@ -0,0 +1,29 @@
+package sparsecat
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// encodeBytes encodes data as a stream of the default format
+func encodeBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	stream, err := io.ReadAll(NewReaderAtEncoder(bytes.NewReader(data), int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stream
+}
+
+// sparseTestData returns a file of size bytes containing a few runs of data between holes
+func sparseTestData(size int) []byte {
+	data := make([]byte, size)
+	for offset := 4096; offset+8192 <= size; offset += 64 * 1024 {
+		copy(data[offset:], bytes.Repeat([]byte{byte(offset >> 12)}, 8192))
+	}
+
+	return data
+}
@@ -0,0 +1,126 @@
+package sparsecat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// NewServerTLSConfig creates the TLS configuration for the receiving side of a transfer. When clientCAFile is
+// set the sending side must authenticate itself using a certificate signed by one of the CAs in that file.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// NewClientTLSConfig creates the TLS configuration for the sending side of a transfer. The certificate of the
+// receiving side is verified using the CAs in caFile, or the system roots when it is empty. The certificate in
+// certFile and keyFile is used for client authentication and is optional.
+func NewClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	var err error
+	if caFile != "" {
+		config.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// SendTLS secures conn using TLS and sends stream using Send. When config doesn't set ServerName the host of the
+// remote address of conn is used to verify the certificate of the receiving side. The TLS connection is closed once
+// the transfer is done, which closes conn as well.
+func SendTLS(conn net.Conn, config *tls.Config, handshake Handshake, stream io.Reader) (Handshake, error) {
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return Handshake{}, fmt.Errorf("error determining server name: %w", err)
+		}
+
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	defer tlsConn.Close()
+
+	// complete the TLS handshake up front so verification errors are reported as such
+	err := tlsConn.Handshake()
+	if err != nil {
+		return Handshake{}, fmt.Errorf("error performing TLS handshake: %w", err)
+	}
+
+	return Send(tlsConn, handshake, stream)
+}
+
+// ReceiveTLS accepts a single connection from listener, secures it using TLS and receives a stream from it using
+// Receive. The connection is closed once the transfer is done, listener is left open.
+func ReceiveTLS(listener net.Listener, config *tls.Config, handshake Handshake, write func(remote Handshake, stream io.Reader) error) (Handshake, error) {
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return Handshake{}, errors.New("a certificate is required to receive using TLS")
+	}
+
+	rawConn, err := listener.Accept()
+	if err != nil {
+		return Handshake{}, fmt.Errorf("error accepting connection: %w", err)
+	}
+
+	conn := tls.Server(rawConn, config)
+	defer conn.Close()
+
+	// complete the TLS handshake up front so authentication errors are reported as such
+	err = conn.Handshake()
+	if err != nil {
+		return Handshake{}, fmt.Errorf("error performing TLS handshake: %w", err)
+	}
+
+	return Receive(conn, handshake, write)
+}
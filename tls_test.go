@@ -0,0 +1,155 @@
+package sparsecat
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newSelfSignedCertificate generates a certificate for 127.0.0.1 that is its own CA
+func newSelfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sparsecat test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: certificate}, pool
+}
+
+// tlsTransfer sends data from a client using clientConfig to a server using serverConfig over localhost. The
+// decoded data and the errors of both sides are returned.
+func tlsTransfer(t *testing.T, data []byte, serverConfig, clientConfig *tls.Config) (received []byte, sendErr, receiveErr error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ReceiveTLS(listener, serverConfig, Handshake{}, func(remote Handshake, stream io.Reader) error {
+			var err error
+			received, err = io.ReadAll(NewDecoder(stream))
+			return err
+		})
+		done <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, sendErr = SendTLS(conn, clientConfig, Handshake{}, NewReaderAtEncoder(bytes.NewReader(data), int64(len(data))))
+	receiveErr = <-done
+
+	return received, sendErr, receiveErr
+}
+
+func TestTLSTransfer(t *testing.T) {
+	serverCertificate, serverPool := newSelfSignedCertificate(t)
+	clientCertificate, clientPool := newSelfSignedCertificate(t)
+	data := sparseTestData(1 << 20)
+
+	tests := []struct {
+		name          string
+		serverConfig  *tls.Config
+		clientConfig  *tls.Config
+		expectFailure bool
+	}{
+		{
+			name:         "server certificate",
+			serverConfig: &tls.Config{Certificates: []tls.Certificate{serverCertificate}},
+			clientConfig: &tls.Config{RootCAs: serverPool},
+		},
+		{
+			name:         "client certificate",
+			serverConfig: &tls.Config{Certificates: []tls.Certificate{serverCertificate}, ClientCAs: clientPool, ClientAuth: tls.RequireAndVerifyClientCert},
+			clientConfig: &tls.Config{RootCAs: serverPool, Certificates: []tls.Certificate{clientCertificate}},
+		},
+		{
+			name:          "untrusted server",
+			serverConfig:  &tls.Config{Certificates: []tls.Certificate{serverCertificate}},
+			clientConfig:  &tls.Config{RootCAs: clientPool},
+			expectFailure: true,
+		},
+		{
+			name:          "missing client certificate",
+			serverConfig:  &tls.Config{Certificates: []tls.Certificate{serverCertificate}, ClientCAs: clientPool, ClientAuth: tls.RequireAndVerifyClientCert},
+			clientConfig:  &tls.Config{RootCAs: serverPool},
+			expectFailure: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received, sendErr, receiveErr := tlsTransfer(t, data, test.serverConfig, test.clientConfig)
+
+			if test.expectFailure {
+				if sendErr == nil || receiveErr == nil {
+					t.Fatalf("expected the transfer to fail, got %v and %v", sendErr, receiveErr)
+				}
+				return
+			}
+
+			if sendErr != nil || receiveErr != nil {
+				t.Fatalf("transfer failed: %v, %v", sendErr, receiveErr)
+			}
+
+			if !bytes.Equal(received, data) {
+				t.Fatal("received data doesn't match the sent data")
+			}
+		})
+	}
+}
+
+func TestReceiveTLSRequiresCertificate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, err = ReceiveTLS(listener, &tls.Config{}, Handshake{}, nil)
+	if err == nil {
+		t.Fatal("expected an error without a certificate")
+	}
+}
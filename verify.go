@@ -0,0 +1,263 @@
+package sparsecat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+// verifyBufferSize is the amount of data compared at once by Verify
+const verifyBufferSize = 1024 * 1024
+
+// VerifyResult is the outcome of comparing a stream to a target.
+type VerifyResult struct {
+	// Size is the file size declared by the stream.
+	Size int64 `json:"size"`
+	// TargetSize is the size of the target, or -1 when it is unknown or the target is a block device.
+	TargetSize int64 `json:"targetSize"`
+	// DataBytes is the amount of data in the sections of the stream that has been compared.
+	DataBytes int64 `json:"dataBytes"`
+	// HoleBytes is the amount of bytes in the holes and zero sections of the stream that have been checked to be zero.
+	HoleBytes int64 `json:"holeBytes"`
+	// MismatchedBytes is the amount of bytes of the target that differ from the stream.
+	MismatchedBytes int64 `json:"mismatchedBytes"`
+	// FirstMismatch is the offset of the first byte of the target that differs from the stream, or -1.
+	FirstMismatch int64 `json:"firstMismatch"`
+}
+
+// Match reports whether the target is identical to the stream.
+func (v *VerifyResult) Match() bool {
+	return v.MismatchedBytes == 0 && (v.TargetSize < 0 || v.TargetSize == v.Size)
+}
+
+// Verify compares a stream of format f to target. See Decoder.Verify.
+func Verify(stream io.Reader, f format.Format, target io.ReaderAt) (*VerifyResult, error) {
+	decoder := NewDecoder(stream)
+	decoder.Format = f
+	return decoder.Verify(target)
+}
+
+// Verify compares the stream to target instead of writing it. The data sections must match the target and the
+// holes of the stream must read as zeros in the target. Holes in front of Offset are not checked. Differences
+// are reported in the result, an error is only returned when the stream or target can't be read. To compare a
+// source file to a target, use an Encoder of the source as the stream.
+func (d *Decoder) Verify(target io.ReaderAt) (*VerifyResult, error) {
+	err := d.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	size := d.header.Size
+
+	v := &verifier{
+		target:   target,
+		expected: make([]byte, verifyBufferSize),
+		actual:   make([]byte, verifyBufferSize),
+		result:   &VerifyResult{Size: size, TargetSize: -1, FirstMismatch: -1},
+	}
+
+	if file, isFile := target.(*os.File); isFile {
+		err = v.inspectTarget(file)
+		if err != nil {
+			return nil, err
+		}
+	} else if sized, ok := target.(interface{ Size() int64 }); ok {
+		v.result.TargetSize = sized.Size()
+	}
+
+	position := d.Offset
+	for {
+		section, err := d.stream.ReadSectionHeader(d.reader)
+		if errors.Is(err, io.EOF) {
+			return v.result, v.compareZeros(position, size)
+		}
+
+		if err != nil {
+			return v.result, err
+		}
+
+		err = v.compareZeros(position, section.Offset)
+		if err != nil {
+			return v.result, err
+		}
+
+		if section.Zero {
+			err = v.compareZeros(section.Offset, section.Offset+section.Length)
+		} else {
+			err = v.compareData(format.GetSectionDataReader(d.stream, d.reader, section), section)
+		}
+
+		if err != nil {
+			return v.result, err
+		}
+
+		if section.Offset+section.Length > position {
+			position = section.Offset + section.Length
+		}
+	}
+}
+
+// verifier compares the content of a stream to a target
+type verifier struct {
+	target io.ReaderAt
+	// extents is used to skip the holes of the target, which are known to be zero
+	extents ExtentSource
+
+	expected []byte
+	actual   []byte
+
+	result *VerifyResult
+}
+
+// inspectTarget determines the size of a target file and whether its holes can be detected. Block devices are
+// usually larger than the file written to them, so their size is not reported.
+func (v *verifier) inspectTarget(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error running stat: %w", err)
+	}
+
+	if IsBlockDevice(info) {
+		return nil
+	}
+
+	extents, err := NewFileExtentSource(file)
+	if err != nil {
+		return fmt.Errorf("error determining extent source: %w", err)
+	}
+
+	v.result.TargetSize, err = extents.Size()
+	if err != nil {
+		return fmt.Errorf("error determining size of target: %w", err)
+	}
+
+	if _, scan := extents.(zeroScanSource); !scan {
+		v.extents = extents
+	}
+
+	return nil
+}
+
+// compareData compares the data of section read from data to the target
+func (v *verifier) compareData(data io.Reader, section format.Section) error {
+	offset := section.Offset
+	end := section.Offset + section.Length
+
+	for offset < end {
+		chunk := v.expected[:minInt64(int64(len(v.expected)), end-offset)]
+		_, err := io.ReadFull(data, chunk)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("error reading data of section at offset %d: %w", section.Offset, err)
+		}
+
+		err = v.compare(offset, chunk)
+		if err != nil {
+			return err
+		}
+
+		v.result.DataBytes += int64(len(chunk))
+		offset += int64(len(chunk))
+	}
+
+	// drain the section so formats can verify what follows the data, such as a checksum
+	_, err := io.Copy(io.Discard, data)
+	return err
+}
+
+// compareZeros checks that the range of the target between start and end reads as zeros
+func (v *verifier) compareZeros(start int64, end int64) error {
+	if end <= start {
+		return nil
+	}
+
+	v.result.HoleBytes += end - start
+
+	for start < end {
+		dataStart, dataEnd := start, end
+		if v.extents != nil {
+			var err error
+			dataStart, dataEnd, err = v.extents.NextExtent(start)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			if err != nil {
+				return fmt.Errorf("error detecting data section of target: %w", err)
+			}
+
+			if dataStart >= end {
+				break
+			}
+
+			if dataEnd > end {
+				dataEnd = end
+			}
+		}
+
+		for offset := dataStart; offset < dataEnd; {
+			chunk := v.expected[:minInt64(int64(len(v.expected)), dataEnd-offset)]
+			for index := range chunk {
+				chunk[index] = 0
+			}
+
+			err := v.compare(offset, chunk)
+			if err != nil {
+				return err
+			}
+
+			offset += int64(len(chunk))
+		}
+
+		start = dataEnd
+	}
+
+	return nil
+}
+
+// compare compares expected to the target at offset and records any difference
+func (v *verifier) compare(offset int64, expected []byte) error {
+	actual := v.actual[:len(expected)]
+	read, err := v.target.ReadAt(actual, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading target at offset %d: %w", offset, err)
+	}
+
+	if bytes.Equal(actual[:read], expected[:read]) && read == len(expected) {
+		return nil
+	}
+
+	// bytes missing from the target all count as mismatched
+	for index := range expected {
+		if index < read && actual[index] == expected[index] {
+			continue
+		}
+
+		if v.result.FirstMismatch < 0 {
+			v.result.FirstMismatch = offset + int64(index)
+		}
+		v.result.MismatchedBytes++
+	}
+
+	return nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
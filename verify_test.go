@@ -0,0 +1,153 @@
+package sparsecat
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/svenwiltink/sparsecat/format"
+)
+
+func TestVerify(t *testing.T) {
+	const kib = 1024
+	const size = 64 * kib
+
+	data := fill(fill(make([]byte, size), 0, 4*kib, 1), 8*kib, 8*kib, 2)
+	sections := []format.Section{
+		{Offset: 0, Length: 4 * kib},
+		{Offset: 8 * kib, Length: 8 * kib},
+		{Offset: 32 * kib, Length: 4 * kib, Zero: true},
+	}
+
+	tests := []struct {
+		name     string
+		sections []format.Section
+		offset   int64
+		target   []byte
+		expected VerifyResult
+	}{
+		{
+			name:     "identical",
+			sections: sections,
+			target:   data,
+			expected: VerifyResult{Size: size, TargetSize: size, DataBytes: 12 * kib, HoleBytes: 52 * kib, FirstMismatch: -1},
+		},
+		{
+			name:     "different data",
+			sections: sections,
+			target:   fill(data, 9*kib, 10, 3),
+			expected: VerifyResult{Size: size, TargetSize: size, DataBytes: 12 * kib, HoleBytes: 52 * kib, MismatchedBytes: 10, FirstMismatch: 9 * kib},
+		},
+		{
+			name:     "data in a hole",
+			sections: sections,
+			target:   fill(data, 20*kib, 1, 3),
+			expected: VerifyResult{Size: size, TargetSize: size, DataBytes: 12 * kib, HoleBytes: 52 * kib, MismatchedBytes: 1, FirstMismatch: 20 * kib},
+		},
+		{
+			name:     "data in a zero section",
+			sections: sections,
+			target:   fill(data, 33*kib, 2, 3),
+			expected: VerifyResult{Size: size, TargetSize: size, DataBytes: 12 * kib, HoleBytes: 52 * kib, MismatchedBytes: 2, FirstMismatch: 33 * kib},
+		},
+		{
+			name:     "smaller target",
+			sections: sections,
+			target:   data[:12*kib],
+			// every byte missing from the target counts as mismatched, holes included
+			expected: VerifyResult{Size: size, TargetSize: 12 * kib, DataBytes: 12 * kib, HoleBytes: 52 * kib, MismatchedBytes: 52 * kib, FirstMismatch: 12 * kib},
+		},
+		{
+			name:     "larger target",
+			sections: sections,
+			target:   append(append([]byte(nil), data...), 1),
+			expected: VerifyResult{Size: size, TargetSize: size + 1, DataBytes: 12 * kib, HoleBytes: 52 * kib, FirstMismatch: -1},
+		},
+		{
+			name:     "offset",
+			sections: sections[1:],
+			offset:   8 * kib,
+			// data in front of the offset isn't checked
+			target:   fill(data, 0, 8*kib, 3),
+			expected: VerifyResult{Size: size, TargetSize: size, DataBytes: 8 * kib, HoleBytes: 48 * kib, FirstMismatch: -1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := writeStream(t, format.SparsecatV1, format.Header{Size: size}, test.sections, data)
+
+			decoder := NewDecoder(bytes.NewReader(stream))
+			decoder.Format = format.SparsecatV1
+			decoder.Offset = test.offset
+
+			result, err := decoder.Verify(bytes.NewReader(test.target))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *result != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, *result)
+			}
+
+			expectMatch := test.expected.MismatchedBytes == 0 && test.expected.TargetSize == size
+			if result.Match() != expectMatch {
+				t.Errorf("expected match to be %t", expectMatch)
+			}
+		})
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	const blockSize = 4096
+	const size = 32*blockSize + 100
+
+	blocks := map[int64]byte{0: 1, 2: 2, 3: 3, 10: 4, 32: 5}
+	source := sparseFile(t, "source", size, blockSize, blocks)
+
+	tests := []struct {
+		name   string
+		blocks map[int64]byte
+		match  bool
+	}{
+		{name: "identical", blocks: blocks, match: true},
+		{name: "changed block", blocks: map[int64]byte{0: 1, 2: 2, 3: 9, 10: 4, 32: 5}},
+		{name: "missing block", blocks: map[int64]byte{0: 1, 2: 2, 10: 4, 32: 5}},
+		{name: "data in a hole", blocks: map[int64]byte{0: 1, 2: 2, 3: 3, 10: 4, 20: 6, 32: 5}},
+		// a block of zeros is allocated but still reads as a hole
+		{name: "allocated zeros", blocks: map[int64]byte{0: 1, 1: 0, 2: 2, 3: 3, 10: 4, 32: 5}, match: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := sparseFile(t, "target", size, blockSize, test.blocks)
+
+			// compare the source file itself, as the verify command does using -source
+			result, err := Verify(NewEncoder(source), format.RbdDiffv1, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Match() != test.match {
+				t.Errorf("expected match to be %t, got %+v", test.match, *result)
+			}
+
+			if result.TargetSize != size {
+				t.Errorf("expected target size %d, got %d", size, result.TargetSize)
+			}
+		})
+	}
+
+	// a target that can't be read is an error rather than a mismatch
+	closed, err := os.Create(filepath.Join(t.TempDir(), "closed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	_, err = Verify(NewEncoder(source), format.RbdDiffv1, closed)
+	if err == nil {
+		t.Error("expected an error verifying a closed target")
+	}
+}